@@ -1,26 +1,33 @@
 package wflambda
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
 )
 
 var (
-	// Is this a cold start or not.
-	coldStart = true
-	// Count the number of cold starts.
-	csCounter = counter{}
-	// Count the number of invocations.
-	invocationsCounter = counter{}
-	// Count the number of errors.
-	errCounter = counter{}
+	// Is this a cold start or not, accessed atomically. It is 1 until the first invocation claimed
+	// the cold start.
+	coldStart int32 = 1
 )
 
 // WavefrontConfig configures the direct ingestion sender to Wavefront.
 type WavefrontConfig struct {
-	// Enabled indicates whether metrics are sent to Wavefront
+	// Enabled indicates whether metrics are sent to Wavefront. A disabled agent calls the handler
+	// without creating a sender, sending any data, or deriving point tags.
 	Enabled *bool
 	// Wavefront URL of the form https://<INSTANCE>.wavefront.com.
 	Server *string
@@ -32,16 +39,366 @@ type WavefrontConfig struct {
 	MaxBufferSize *int
 	// Map of Key-Value pairs (strings) associated with each data point sent to Wavefront.
 	PointTags map[string]string
+	// Source of all metrics, including custom metrics and gauges. Defaults to the name of the function.
+	MetricSource string
+	// Source of all delta counters, including the built-in counters like aws.lambda.wf.invocations
+	// and custom counters, like the name of a service to aggregate the counts of its functions under.
+	// Defaults to the name of the function.
+	CounterSource string
+	// Environment, like dev or prod, that is sent as the env point tag with each data point. When it is
+	// empty, the environment variable ENVIRONMENT is used, or else STAGE, unless PointTags or
+	// StaticPointTags already have an env tag.
+	Environment string
+	// Point tags, like env or team, that are added to each data point. PointTags win over them on a
+	// key collision, and with the DefaultTagPrecedence so do all tags derived from AWS.
+	StaticPointTags map[string]string
+	// Hostname of a Wavefront proxy. When it is set the data is sent through the proxy instead of
+	// directly to Server.
+	ProxyHost *string
+	// Port on which the Wavefront proxy listens for metrics. Defaults to 2878.
+	ProxyPort *int
+	// Interval at which the sender flushes data in the background, in addition to the flush at the end
+	// of every invocation. It is rounded up to whole seconds. Defaults to 1 second.
+	FlushInterval time.Duration
+	// HTTP client through which the direct ingestion sender reports to Server, to set timeouts, a proxy,
+	// or TLS roots. It replaces the direct sender of the Wavefront SDK with one that ignores
+	// FlushInterval, so the data is only flushed at the end of every invocation. Defaults to the client
+	// of the Wavefront SDK.
+	HTTPClient *http.Client
+	// Sender that the data is sent through instead of a direct ingestion sender to Server. Server, Token,
+	// BatchSize, and MaxBufferSize aren't used when it is set.
+	Sender Sender
+	// Called when closing the sender at the end of an invocation fails, which may mean that data wasn't
+	// delivered. The error is logged either way.
+	OnCloseError func(err error)
+	// Fraction (between 0 and 1) of invocations for which metrics are sent. Counters are always sent.
+	SampleRate *float64
+	// Decides, after the handler returned, whether the metrics of the invocation are sent. It gets the
+	// context and payload passed to the handler, the duration of the handler, and the error it
+	// returned. When it is set, SampleRate is ignored. Counters are always sent, and invocations for
+	// which the handler called ForceSample are always sampled.
+	SamplingDecider func(ctx context.Context, payload interface{}, duration time.Duration, err error) bool
+	// CountLogLines sends the number of lines written through Logger during an invocation.
+	CountLogLines bool
+	// Number of points after which the sender is flushed, in addition to the flush interval and the
+	// flush at the end of each invocation. Zero disables flushing on a threshold.
+	FlushAtPoints int
+	// Function that fetches the AWS resource tags of the function with the given ARN. It is called
+	// once per container and the result is cached. The lambdatags package provides an implementation
+	// based on the AWS SDK.
+	ResourceTags func(arn string) (map[string]string, error)
+	// AWS resource tags, fetched through ResourceTags, that are promoted to point tags.
+	ResourceTagKeys []string
+	// Function that decorates the context passed to the handler, for example to add request-scoped
+	// dependencies. It is called on every invocation, right before the handler.
+	ContextDecorator func(context.Context) context.Context
+	// Function that is called with the recovered value when the handler panics, instead of panicking
+	// again after the panic is reported. It can, for example, exit the process. If it returns, the
+	// invocation returns an error describing the panic.
+	OnPanic func(recovered interface{})
+	// RecoverPanics returns an error describing the panic when the handler panics, instead of panicking
+	// again after the panic is reported. OnPanic, when it is set, is still called.
+	RecoverPanics bool
+	// StageFromAlias sends the alias the function was invoked with as the Stage point tag. When the
+	// function was invoked with a version, the environment variable WAVEFRONT_STAGE is used instead.
+	StageFromAlias bool
+	// CountersFirst sends the counters before the metrics, so the counters still make it to Wavefront
+	// when the invocation runs out of time while sending.
+	CountersFirst bool
+	// ColdStartGauge sends the aws.lambda.wf.coldstart metric, which is 1 for a cold start and 0 for
+	// a warm start, alongside the coldstarts counter.
+	ColdStartGauge bool
+	// VpcTags sends the Vpc and Subnet point tags, taken from the environment variables
+	// WAVEFRONT_VPC_ID and WAVEFRONT_SUBNET_ID.
+	VpcTags bool
+	// Soft SLA for the duration of the handler. Every invocation that takes longer increments the
+	// aws.lambda.wf.sla_violations counter. Zero disables the counter.
+	SLA time.Duration
+	// Floor for the aws.lambda.wf.duration metric, so very fast invocations don't look like missing
+	// data in dashboards. Durations below it are reported as MinDuration, which isn't their real
+	// value. Only that metric is affected. Zero reports the real duration.
+	MinDuration time.Duration
+	// Map of Key-Value pairs (strings) added to each data point instead of the tags derived from the
+	// ARN, when the function runs without one (like locally or in tests). PointTags take precedence.
+	FallbackTags map[string]string
+	// Function that derives the point tags from the ARN of the invoked function, for ARN formats that
+	// ParseARNTags doesn't handle. It can call ParseARNTags and change its result. Defaults to
+	// ParseARNTags.
+	ARNParser func(arn string) map[string]string
+	// Order in which the point tags of the different sources are merged, where later sources win when
+	// they set the same key. Sources that aren't listed are merged first. Defaults to
+	// DefaultTagPrecedence.
+	TagPrecedence []TagSource
+	// Maximum number of point tags sent with a point. When a point has more, the tags from the sources
+	// with the lowest TagPrecedence are dropped and a warning is logged. Defaults to 20, the limit of
+	// Wavefront.
+	MaxPointTags int
+	// Number of times the handler is called again when it returns an error or panics. Only use this
+	// for idempotent handlers. The outcome of the last attempt is returned to Lambda.
+	HandlerRetries int
+	// Time to wait before the first retry of the handler, which doubles for every next retry.
+	// Defaults to 100ms.
+	HandlerRetryBackoff time.Duration
+	// PrintSummary prints a single JSON line with the duration, cold start, error, memory, and point
+	// tags of every invocation to stdout, which is useful during local development.
+	PrintSummary bool
+	// Prefixes under which the built-in metrics are sent, instead of aws.lambda.wf. Every built-in
+	// metric is sent once for each prefix.
+	MetricPrefixes []string
+	// StrictContext only passes the context to handlers whose first argument is exactly of type
+	// context.Context. Handlers with a first argument of a type that merely implements it are rejected.
+	StrictContext bool
+	// Interval at which the aws.lambda.wf.canary metric, with a fixed value of 1, is sent to check that
+	// the pipeline to Wavefront works. It is sent on the first invocation and then on the first
+	// invocation after every interval. Zero disables the canary.
+	CanaryInterval time.Duration
+	// BilledDuration sends the aws.lambda.wf.billed_duration metric, which is the duration of the
+	// handler rounded up to the next millisecond, unless BilledDurationSource knows the billed duration.
+	BilledDuration bool
+	// Function that returns the billed duration, as reported by the platform, for the invocation with
+	// the given request ID, for example from a Telemetry API extension. It returns false when the
+	// billed duration isn't available.
+	BilledDurationSource func(requestID string) (time.Duration, bool)
+	// ProvisionedTag sends the provisioned point tag, which is true for containers initialized for
+	// provisioned concurrency and false for containers initialized on demand.
+	ProvisionedTag bool
+	// GoMaxProcsTag sends the GoMaxProcs point tag, which is the GOMAXPROCS setting of the Go runtime.
+	GoMaxProcsTag bool
+	// ExtensionsTag sends the Extensions point tag, which is true when the function runs with external
+	// Lambda extensions and false when it doesn't.
+	ExtensionsTag bool
+	// RequestIDTag sends the RequestId point tag, which is the AWS request ID of the invocation, to find
+	// its logs in CloudWatch. Every invocation creates new series, so it is meant for debugging.
+	RequestIDTag bool
+	// EnvTags adds the environment variables whose name starts with EnvTagPrefix as point tags, with the
+	// prefix stripped from the key. On a key collision they win over PointTags, like all environment
+	// variables win over the configuration.
+	EnvTags bool
+	// Prefix of the environment variables that are added as point tags when EnvTags is set. Defaults
+	// to WF_TAG_.
+	EnvTagPrefix string
+	// ShutdownOnSIGTERM calls Shutdown when the process receives SIGTERM.
+	ShutdownOnSIGTERM bool
+	// Time Shutdown waits for in-flight invocations to finish before it flushes and closes the sender.
+	ShutdownGracePeriod time.Duration
+	// Function that rewrites the key and value of every point tag just before it is sent. Tags for
+	// which it returns an empty key or value are dropped.
+	TagTransform func(key, value string) (string, string)
+	// MemoryHeadroom sends the aws.lambda.wf.mem.headroom metric, which is the memory limit of the
+	// function minus the highest used memory observed in the container, in megabytes.
+	MemoryHeadroom bool
+	// MemoryGrowth sends the aws.lambda.wf.mem.growth metric, which is the used memory after the
+	// handler minus the used memory before it, in megabytes. It reads the memory statistics twice
+	// per invocation.
+	MemoryGrowth bool
+	// CPUTime sends the aws.lambda.wf.cpu.user and aws.lambda.wf.cpu.system metrics, which are the
+	// user and system CPU time of the process during the handler, in milliseconds. They are omitted
+	// on platforms without CPU accounting.
+	CPUTime bool
+	// Goroutines sends the aws.lambda.wf.goroutines metric, which is the number of goroutines at the
+	// end of the invocation.
+	Goroutines bool
+	// GCStats sends the aws.lambda.wf.gc.num and aws.lambda.wf.gc.pause_ms metrics, which are the
+	// number of completed GC cycles and their total pause time in milliseconds since the container
+	// started. Reading them stops the world briefly at the end of every invocation.
+	GCStats bool
+	// Names of the built-in metrics and counters that are sent, like aws.lambda.wf.duration. Built-in
+	// metrics that aren't listed are never collected. Defaults to all built-in metrics.
+	EnabledMetrics []string
+	// Max number of distinct custom metrics and counters the agent buffers. New ones beyond this
+	// limit are dropped and counted by aws.lambda.wf.custom_metrics_dropped. Defaults to 1000.
+	MaxCustomMetrics int
+	// OpenMetrics writes the metrics and counters of every invocation to stdout in the OpenMetrics
+	// text format, in addition to sending them to Wavefront.
+	OpenMetrics bool
+	// Number of buckets the payload is hashed into for the aws.lambda.wf.event_hash counter, which is
+	// tagged with the bucket. Zero disables the counter.
+	EventHashBuckets int
+	// Top-level field of the payload that is hashed instead of the whole payload.
+	EventHashField string
+	// Basis of the aws.lambda.wf.mem.percentage metric: "total" (the default) for the memory visible to
+	// the container, or "limit" for the memory size configured for the function.
+	MemoryPercentBasis string
+	// ContainerStarted sends the aws.lambda.wf.container.started metric once per container, on the
+	// first invocation, tagged with the Go version, architecture, and memory size.
+	ContainerStarted bool
+	// ColdStartDuration sends the aws.lambda.wf.coldstart.duration_ms metric on the cold start
+	// invocation, which is the time from the initialization of the package until that invocation in
+	// milliseconds.
+	ColdStartDuration bool
+	// ContainerRegistration sends the aws.lambda.wf.container.registered metric once per container,
+	// on its first invocation, tagged with a random ContainerID. Counting the distinct IDs over a
+	// window estimates the number of containers. No other metric gets the ContainerID tag, so its
+	// cardinality stays limited to this metric.
+	ContainerRegistration bool
+	// Number of times sending a counter is retried when it fails, right away. Metrics are sent once,
+	// unless RetryPolicy is set, as losing a single metric is less harmful than losing a delta.
+	CounterSendRetries int
+	// RetryPolicy retries failed sends of metrics and counters with a backoff. Counters are retried
+	// at least CounterSendRetries times. Defaults to no retries.
+	RetryPolicy *RetryPolicy
+	// CircuitBreaker stops sending data for a while after sends keep failing, so an outage of Wavefront
+	// doesn't slow down the function. Defaults to no circuit breaker.
+	CircuitBreaker *CircuitBreaker
+	// Maximum time the invocation waits for the sender to flush and close at its end. When they take
+	// longer the response is returned anyway, and the flush goes on in the background. Until it
+	// completes, later invocations drop their data instead of waiting for it. Defaults to 0, which
+	// waits until they complete.
+	FlushTimeout time.Duration
+	// FlushOnErrorOnly drops the metrics of routine invocations, which are warm invocations without
+	// an error, and only sends metrics for invocations that failed or were a cold start. The counters
+	// of routine invocations are still sent, but are only flushed once every FlushInterval, or with
+	// the next invocation that failed or was a cold start.
+	FlushOnErrorOnly bool
+	// Time before the deadline of the invocation at which the aws.lambda.wf.deadline_exceeded_while_running
+	// counter is sent and flushed when the handler is still running, so a handler that never returns
+	// still leaves a trace before Lambda stops it. Defaults to 0, which doesn't watch the deadline.
+	DeadlineWatchdog time.Duration
+	// MillisecondTimestamps sends metrics with timestamps in epoch milliseconds instead of epoch
+	// seconds, so metrics of invocations within the same second get distinct timestamps.
+	MillisecondTimestamps bool
+	// Map of point tag names to dot separated paths into the JSON representation of the response of
+	// the handler, like "routing.region". The values of these fields are added as point tags to the
+	// metrics of the invocation. Fields that are missing or that aren't a string, number, or boolean are
+	// skipped.
+	ResponseTags map[string]string
+	// Called with the response of the handler, when the handler didn't return an error. The value it
+	// returns replaces the response that is returned to Lambda, and is the one ResponseTags are taken
+	// from, so it can be used to strip or redact fields.
+	ResponseInterceptor func(response interface{}) interface{}
+	// Dot separated path into the JSON representation of the response, like error, of a field that
+	// signals an application error. When the handler returns no error but the field is set, the
+	// invocation counts in aws.lambda.wf.errors, with the errorType point tag set to response. Fields
+	// that are missing, empty, false, or 0 are no error.
+	ResponseErrorPath string
+	// Maximum number of distinct values sent for each of the ResponseTags and StepFunctionsTags, after
+	// which new values are skipped to bound the cardinality. Defaults to 20.
+	MaxResponseTagValues int
+	// Map of point tag names to dot separated paths into the event of a Step Functions task, like
+	// StateMachine to stateMachine.name. Step Functions only passes its context object to the task
+	// when the Parameters of the state include it, like "stateMachine.$": "$$.StateMachine". The values
+	// are added as point tags to the metrics of the invocation, up to MaxResponseTagValues distinct
+	// values per tag. Events without the fields, like when the function isn't invoked as a task, get
+	// no tags.
+	StepFunctionsTags map[string]string
+	// Overhead sends the aws.lambda.wf.overhead metric, which is the time the wrapper spent on its own
+	// work during the invocation, up to sending the metrics, in milliseconds.
+	Overhead bool
+	// FlushDuration sends the aws.lambda.wf.flush_duration metric, which is the time the previous
+	// invocation spent on sending, flushing, and closing the sender, in milliseconds. An invocation
+	// can't send the duration of its own flush, so it is sent with the next invocation.
+	FlushDuration bool
+	// ConfiguredTimeout sends the aws.lambda.wf.configured_timeout metric, which is the time from the
+	// start of the invocation until the deadline of its context in milliseconds, and so the timeout of
+	// the function. It isn't sent for contexts without a deadline.
+	ConfiguredTimeout bool
+	// TimeRemaining sends the aws.lambda.wf.time_remaining_ms metric, which is the time from the end of
+	// the handler until the deadline of its context in milliseconds, together with the
+	// aws.lambda.wf.timeout_ms metric, which is the time from the start of the invocation until that
+	// deadline, to compare it to. They aren't sent for contexts without a deadline.
+	TimeRemaining bool
+	// Regions from which data is sent to Wavefront. In other regions the handler is called without
+	// sending any data. The region is taken from the invoked function ARN, or from the environment
+	// variable AWS_REGION. Defaults to all regions.
+	RegionAllowList []string
+	// BackgroundFlush returns the response of the handler without waiting for the data to be flushed
+	// to Wavefront. The flush continues in the background, and the next invocation or Shutdown waits
+	// for it. Lambda may freeze the container as soon as the response is returned, so data can arrive
+	// late, as late as the next invocation, or get lost when the container is shut down without
+	// Shutdown being called.
+	BackgroundFlush bool
+	// Patterns that classify the message of an error into the ErrorPattern point tag of the
+	// aws.lambda.wf.errors counter. The name of the first pattern that matches is used, or other when
+	// none matches.
+	ErrorPatterns []ErrorPattern
+	// CommonTags registers the point tags that are shared by the points with the sender once, and only
+	// sends the tags that differ with each point, when the sender is a CommonTagsSender. Otherwise all
+	// tags are sent with each point.
+	CommonTags bool
+	// Functions, keyed by metric name, that transform the value of a metric or counter right before it
+	// is sent, like to rescale it to a different unit. The names are the ones the metrics are
+	// registered with, like aws.lambda.wf.mem.percentage, regardless of MetricPrefixes.
+	ValueTransform map[string]func(float64) float64
 }
 
 // WavefrontAgent is the agent instance that communicates with Wavefront.
 type WavefrontAgent struct {
 	*WavefrontConfig
-	metrics  map[string]float64
-	counters map[string]float64
-	sender   wavefront.Sender
+	// metricsMu guards metrics, counters, custom, and the other state that invocations use to
+	// assemble their metrics.
+	metricsMu sync.Mutex
+	metrics   map[string]float64
+	counters  map[string]float64
+	custom    []Metric
+	sender    Sender
+	// senderMu serializes all operations on the sender.
+	senderMu sync.Mutex
+	// Number of points sent since the last flush.
+	pendingPoints int
+	// AWS resource tags promoted to point tags, fetched once per container.
+	resourceTagsOnce sync.Once
+	resourceTags     map[string]string
+	// Time the canary metric was last sent.
+	lastCanary time.Time
+	// Number of invocations in flight, accessed atomically.
+	inFlight int64
+	// Highest used memory observed in the container.
+	memPeak peakTracker
+	// Reads the memory statistics, which tests replace. Defaults to getMemoryStats.
+	readMemStats func() *memStats
+	// Reads the CPU times of the process, which tests replace. Defaults to getCPUTimes.
+	readCPUTimes func() (*cpuTimes, bool)
+	// Number of distinct custom metrics buffered, and the number dropped since the last invocation.
+	customMu       sync.Mutex
+	customMetrics  int
+	droppedMetrics int
+	// Makes sure the container started metric is only sent once.
+	startedOnce sync.Once
+	// Makes sure the container registered metric is only sent once.
+	registeredOnce sync.Once
+	// The distinct values sent for each of the ResponseTags.
+	responseTagValues map[string]map[string]bool
+	// The distinct values sent for each of the StepFunctionsTags.
+	stepFunctionsTagValues map[string]map[string]bool
+	// Tracks the flush of the previous invocation when BackgroundFlush is set.
+	backgroundFlush sync.WaitGroup
+	// Tracks the flushes with a FlushTimeout, which may outlive their invocation.
+	timedFlushes sync.WaitGroup
+	// Number of flushes abandoned by FlushTimeout that still run, accessed atomically.
+	abandonedFlushes int32
+	// Common point tags registered with the sender when CommonTags is set.
+	commonTags map[string]string
+	// Delta counters registered with RegisterDeltaCounter.
+	deltaCountersMu sync.Mutex
+	deltaCounters   map[string]*Counter
+	// Gauges set with SetGauge.
+	gaugesMu sync.Mutex
+	gauges   map[string]float64
+	// Ranks of the point tags of the last invocation, as returned by mergeTags, and whether tags were
+	// dropped because there were more than MaxPointTags.
+	tagRanks   map[string]int
+	tagsCapped bool
+	// Duration in nanoseconds of the flush of the previous invocation, accessed atomically. It is 0
+	// when there is none to send.
+	flushDuration int64
+	// Time until which the invocation may wait for retries of the RetryPolicy. It is zero when the time
+	// isn't limited. Guarded by senderMu.
+	retryDeadline time.Time
+	// Time of the last flush, guarded by senderMu.
+	lastFlush time.Time
+	// State of the CircuitBreaker, guarded by senderMu.
+	breaker breaker
+	// The EnabledMetrics as a set, which is nil when all built-in metrics are enabled.
+	enabledMetrics map[string]bool
+	// Count the number of cold starts, invocations, and errors of the handler of this agent.
+	csCounter          counter
+	invocationsCounter counter
+	errCounter         counter
 }
 
+// builtinPrefix is the prefix of the names of all built-in metrics.
+const builtinPrefix = "aws.lambda.wf."
+
 var (
 	// Default value whether the agent is enabled or not.
 	defaultEnabled = true
@@ -51,22 +408,143 @@ var (
 	defaultMaxBufferSize = 50000
 	// Default interval (in seconds) at which to flush data to Wavefront.
 	defaultFlushIntervalSeconds = 1
+	// Default port on which the Wavefront proxy listens for metrics.
+	defaultProxyPort = 2878
+	// Default fraction of invocations for which metrics are sent.
+	defaultSampleRate = 1.0
+	// Default time to wait before retrying the handler.
+	defaultHandlerRetryBackoff = 100 * time.Millisecond
+	// Default max number of distinct custom metrics.
+	defaultMaxCustomMetrics = 1000
+	// Default max number of distinct values per response tag.
+	defaultMaxResponseTagValues = 20
+	// Default max number of point tags per point, which is the limit of Wavefront.
+	defaultMaxPointTags = 20
 )
 
-// NewWavefrontAgent returns a new agent.
-func NewWavefrontAgent(w *WavefrontConfig) *WavefrontAgent {
-	// Create a new instance of the WavefrontAgent.
-	wfAgent := &WavefrontAgent{
-		metrics:         make(map[string]float64),
-		counters:        make(map[string]float64),
-		WavefrontConfig: w,
+// NewWavefrontAgent returns a new agent configured by opts, like
+//
+//	NewWavefrontAgent(WithDirectIngestion(server, token), WithPointTag("team", "payments"))
+//
+// A *WavefrontConfig can be passed as an option too, which keeps NewWavefrontAgent(&WavefrontConfig{})
+// working. The other options are then applied to that configuration.
+func NewWavefrontAgent(opts ...Option) *WavefrontAgent {
+	return newWavefrontAgent(newConfig(opts), nil)
+}
+
+// NewWavefrontAgentE is like NewWavefrontAgent, but it returns an error instead of an agent when a
+// connection setting is invalid, like an empty proxy host, or when the sender can't be created from
+// the settings and environment variables, so that a misconfigured function fails at startup rather
+// than on its first invocation.
+func NewWavefrontAgentE(opts ...Option) (*WavefrontAgent, error) {
+	w := newConfig(opts)
+	if err := validateConfig(w); err != nil {
+		return nil, err
+	}
+	wa, err := newWavefrontAgentE(w, nil)
+	if err != nil {
+		return nil, err
+	}
+	return wa, nil
+}
+
+// newConfig returns the configuration of the last *WavefrontConfig in opts, or a new one, with all
+// opts applied to it.
+func newConfig(opts []Option) *WavefrontConfig {
+	w := &WavefrontConfig{}
+	for _, opt := range opts {
+		if config, ok := opt.(*WavefrontConfig); ok && config != nil {
+			w = config
+		}
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt.apply(w)
+		}
+	}
+	return w
+}
+
+// newWavefrontAgent returns a new agent that uses the given sender, or the Sender of w when sender is
+// nil. When both are nil, it uses a direct ingestion sender configured from w and the environment
+// variables. When that sender can't be created, the error is logged and the agent has no sender.
+func newWavefrontAgent(w *WavefrontConfig, sender Sender) *WavefrontAgent {
+	wfAgent, err := newWavefrontAgentE(w, sender)
+	if err != nil {
+		log.Printf("ERROR :: %s", err.Error())
+	}
+	return wfAgent
+}
+
+// newWavefrontAgentE is like newWavefrontAgent, but it returns the error when the sender can't be
+// created, together with the agent without a sender.
+func newWavefrontAgentE(w *WavefrontConfig, sender Sender) (*WavefrontAgent, error) {
+	sender, err := resolveConfig(w, sender)
+	wfAgent := newAgent(w, sender)
+	if err != nil {
+		return wfAgent, err
 	}
 
+	if *w.Enabled && w.ShutdownOnSIGTERM {
+		wfAgent.shutdownOnSIGTERM()
+	}
+
+	return wfAgent, nil
+}
+
+// newAgent returns a new agent with the resolved configuration w and sender, and its own metrics and
+// counters.
+func newAgent(w *WavefrontConfig, sender Sender) *WavefrontAgent {
+	return &WavefrontAgent{
+		metrics:                make(map[string]float64),
+		counters:               make(map[string]float64),
+		responseTagValues:      make(map[string]map[string]bool),
+		stepFunctionsTagValues: make(map[string]map[string]bool),
+		deltaCounters:          make(map[string]*Counter),
+		gauges:                 make(map[string]float64),
+		WavefrontConfig:        w,
+		sender:                 sender,
+		enabledMetrics:         metricSet(w.EnabledMetrics),
+	}
+}
+
+// resolveConfig completes w with the point tags of the container and the settings of the environment
+// variables, and returns the given sender, or the Sender of w when sender is nil. When both are nil,
+// it returns a new sender configured from w and the environment variables. A disabled configuration
+// gets no sender.
+func resolveConfig(w *WavefrontConfig, sender Sender) (Sender, error) {
 	// Create an empty map of point tags if no tags exist yet.
 	if w.PointTags == nil {
 		w.PointTags = make(map[string]string)
 	}
 
+	// Add the point tags that are static for the container.
+	if w.ProvisionedTag {
+		if provisioned, ok := provisionedTag(); ok {
+			w.PointTags["provisioned"] = provisioned
+		}
+	}
+	if w.GoMaxProcsTag {
+		w.PointTags["GoMaxProcs"] = strconv.Itoa(runtime.GOMAXPROCS(0))
+	}
+	if w.ExtensionsTag {
+		if extensions, ok := extensionsTag(extensionsDir); ok {
+			w.PointTags["Extensions"] = extensions
+		}
+	}
+	if env := environment(w.Environment); env != "" && (w.Environment != "" || !hasEnvTag(w)) {
+		w.PointTags["env"] = env
+	}
+	if w.EnvTags {
+		prefix := w.EnvTagPrefix
+		if prefix == "" {
+			prefix = defaultEnvTagPrefix
+		}
+		for k, v := range envTags(prefix) {
+			w.PointTags[k] = v
+		}
+	}
+
 	// Create the configuration to connect to Wavefront. Details are gathered from both
 	// the WavefrontConfig and the environment variables. If both WavefrontConfig and
 	// environment variables have a value for a specific setting, the environment variable
@@ -80,9 +558,9 @@ func NewWavefrontAgent(w *WavefrontConfig) *WavefrontAgent {
 		enabled = stringToBool(envEnabled)
 	}
 
-	wfAgent.WavefrontConfig.Enabled = enabled
+	w.Enabled = enabled
 	if !*enabled {
-		return wfAgent
+		return nil, nil
 	}
 
 	envServer := os.Getenv("WAVEFRONT_URL")
@@ -123,22 +601,90 @@ func NewWavefrontAgent(w *WavefrontConfig) *WavefrontAgent {
 		}
 	}
 
-	dc := &wavefront.DirectConfiguration{
-		Server:               *server,
-		Token:                *token,
-		BatchSize:            *batchSize,
-		MaxBufferSize:        *maxBufferSize,
-		FlushIntervalSeconds: 1,
+	envProxyHost := os.Getenv("WAVEFRONT_PROXY_HOST")
+	proxyHost := &envProxyHost
+	if w.ProxyHost != nil && len(envProxyHost) == 0 {
+		proxyHost = w.ProxyHost
 	}
 
-	sender, err := wavefront.NewDirectSender(dc)
-	if err != nil {
-		log.Printf("ERROR :: %s", err.Error())
+	proxyPort := &defaultProxyPort
+	envProxyPort := os.Getenv("WAVEFRONT_PROXY_PORT")
+	if w.ProxyPort != nil {
+		proxyPort = w.ProxyPort
+	}
+	if envProxyPort != "" {
+		proxyPortInt, err := stringToInt(envProxyPort)
+		if err == nil {
+			w.ProxyPort = proxyPortInt
+			proxyPort = proxyPortInt
+		}
 	}
 
-	wfAgent.sender = sender
+	flushIntervalSeconds := defaultFlushIntervalSeconds
+	if w.FlushInterval > 0 {
+		flushIntervalSeconds = int((w.FlushInterval + time.Second - 1) / time.Second)
+	}
 
-	return wfAgent
+	sampleRate := &defaultSampleRate
+	envSampleRate := os.Getenv("WAVEFRONT_SAMPLE_RATE")
+	if w.SampleRate != nil {
+		sampleRate = w.SampleRate
+	}
+	if envSampleRate != "" {
+		sampleRateFloat, err := stringToFloat(envSampleRate)
+		if err == nil {
+			sampleRate = sampleRateFloat
+		}
+	}
+	w.SampleRate = sampleRate
+
+	if sender == nil {
+		sender = w.Sender
+	}
+	var err error
+	switch {
+	case sender != nil:
+	case *proxyHost != "":
+		if *proxyPort < 1 || *proxyPort > 65535 {
+			err = fmt.Errorf("wavefront proxy port %d is out of range", *proxyPort)
+			break
+		}
+		pc := &wavefront.ProxyConfiguration{
+			Host:                 *proxyHost,
+			MetricsPort:          *proxyPort,
+			FlushIntervalSeconds: flushIntervalSeconds,
+		}
+
+		var proxySender wavefront.Sender
+		if proxySender, err = wavefront.NewProxySender(pc); err == nil {
+			sender = SDKSender(proxySender)
+		}
+	case w.HTTPClient != nil:
+		if err = validateDirectIngestion(*server, *token); err != nil {
+			break
+		}
+		var httpSender *httpSender
+		if httpSender, err = newHTTPSender(w.HTTPClient, *server, *token, *batchSize, *maxBufferSize); err == nil {
+			sender = httpSender
+		}
+	default:
+		if err = validateDirectIngestion(*server, *token); err != nil {
+			break
+		}
+		dc := &wavefront.DirectConfiguration{
+			Server:               *server,
+			Token:                *token,
+			BatchSize:            *batchSize,
+			MaxBufferSize:        *maxBufferSize,
+			FlushIntervalSeconds: flushIntervalSeconds,
+		}
+
+		var directSender wavefront.Sender
+		if directSender, err = wavefront.NewDirectSender(dc); err == nil {
+			sender = SDKSender(directSender)
+		}
+	}
+	return sender, err
 }
 
 // Wrapper wraps the handler
@@ -150,12 +696,561 @@ func (wa *WavefrontAgent) Wrapper(handler interface{}) interface{} {
 	return wrapHandler(handler, wa)
 }
 
+// WrapHandlerE wraps the handler like Wrapper, but validates its signature right away and returns an
+// error when it isn't a valid Lambda handler, so a misconfigured function fails at startup instead of
+// on its first invocation, like
+//
+//	handler, err := wflambda.WrapHandlerE(handler, wfAgent)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	lambda.StartHandler(handler)
+func WrapHandlerE(handler interface{}, wa *WavefrontAgent) (lambda.Handler, error) {
+	if _, err := validateHandler(handler, wa.WavefrontConfig.StrictContext); err != nil {
+		return nil, err
+	}
+	if !*wa.Enabled {
+		return lambda.NewHandler(handler), nil
+	}
+	return lambda.NewHandler(wrapHandler(handler, wa)), nil
+}
+
 // RegisterMetric adds a new metric to be sent to Wavefront
 func (wa *WavefrontAgent) RegisterMetric(name string, value float64) {
+	wa.metricsMu.Lock()
+	defer wa.metricsMu.Unlock()
+	if _, ok := wa.metrics[name]; !ok && !wa.allowCustomMetric() {
+		return
+	}
 	wa.metrics[name] = value
 }
 
-// RegisterCounter adds a new DeltaCounter to be sent to Wavefront
+// RegisterCounter adds a new DeltaCounter to be sent to Wavefront with the next invocation
 func (wa *WavefrontAgent) RegisterCounter(name string, value float64) {
+	wa.metricsMu.Lock()
+	defer wa.metricsMu.Unlock()
+	if _, ok := wa.counters[name]; !ok && !wa.allowCustomMetric() {
+		return
+	}
 	wa.counters[name] = value
 }
+
+// SetGauge sets the gauge with the given name to value. The latest value of every gauge is sent with
+// the metrics of each invocation. Gauges can be set from any goroutine. It returns an error when the
+// name is in the aws.lambda.wf. namespace of the built-in metrics, or when more than MaxCustomMetrics
+// are registered.
+func (wa *WavefrontAgent) SetGauge(name string, value float64) error {
+	if strings.HasPrefix(name, builtinPrefix) {
+		return fmt.Errorf("gauge %s uses the reserved prefix %s", name, builtinPrefix)
+	}
+	wa.gaugesMu.Lock()
+	defer wa.gaugesMu.Unlock()
+	if _, ok := wa.gauges[name]; !ok && !wa.allowCustomMetric() {
+		return fmt.Errorf("gauge %s dropped because more than the maximum number of custom metrics are registered", name)
+	}
+	wa.gauges[name] = value
+	return nil
+}
+
+// RegisterDeltaCounter returns the delta counter with the given name, which is registered on the first
+// call for that name. The counter can be incremented from any goroutine, and its value is sent with
+// the counters of every invocation, after which it starts again from zero. When more than
+// MaxCustomMetrics are registered, the returned counter isn't sent.
+func (wa *WavefrontAgent) RegisterDeltaCounter(name string) *Counter {
+	wa.deltaCountersMu.Lock()
+	defer wa.deltaCountersMu.Unlock()
+	if c, ok := wa.deltaCounters[name]; ok {
+		return c
+	}
+	c := &Counter{}
+	if wa.allowCustomMetric() {
+		wa.deltaCounters[name] = c
+	}
+	return c
+}
+
+// allowCustomMetric reports whether another custom metric can be buffered without exceeding
+// MaxCustomMetrics. When it can't, the metric is counted as dropped.
+func (wa *WavefrontAgent) allowCustomMetric() bool {
+	max := wa.WavefrontConfig.MaxCustomMetrics
+	if max <= 0 {
+		max = defaultMaxCustomMetrics
+	}
+	wa.customMu.Lock()
+	defer wa.customMu.Unlock()
+	if wa.customMetrics < max {
+		wa.customMetrics++
+		return true
+	}
+	if wa.droppedMetrics == 0 {
+		log.Printf("WARNING :: more than %d custom metrics registered, dropping new ones", max)
+	}
+	wa.droppedMetrics++
+	return false
+}
+
+// releaseCustomMetrics makes room for n custom metrics that aren't buffered anymore.
+func (wa *WavefrontAgent) releaseCustomMetrics(n int) {
+	wa.customMu.Lock()
+	defer wa.customMu.Unlock()
+	wa.customMetrics -= n
+}
+
+// takeDroppedMetrics returns the number of custom metrics dropped since the last call.
+func (wa *WavefrontAgent) takeDroppedMetrics() int {
+	wa.customMu.Lock()
+	defer wa.customMu.Unlock()
+	dropped := wa.droppedMetrics
+	wa.droppedMetrics = 0
+	return dropped
+}
+
+// sendMetric sends a single metric to Wavefront through the sender of the agent.
+func (wa *WavefrontAgent) sendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	if !wa.lockSender() {
+		return nil
+	}
+	defer wa.senderMu.Unlock()
+	return wa.sendMetricLocked(name, value, ts, source, tags)
+}
+
+// sendMetricLocked sends a single metric to Wavefront. The caller must hold senderMu.
+func (wa *WavefrontAgent) sendMetricLocked(name string, value float64, ts int64, source string, tags map[string]string) error {
+	for _, point := range wa.metricPoints(name, value, ts, source, tags) {
+		point := point
+		err := wa.guard(func() error {
+			return wa.sendWithRetries(point.Name, 0, func() error {
+				return wa.sender.SendMetric(point.Name, point.Value, point.Timestamp, point.Source, point.Tags)
+			})
+		})
+		if err != nil {
+			return err
+		}
+		if err := wa.pointSent(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendDeltaCounter sends a single delta counter to Wavefront through the sender of the agent.
+func (wa *WavefrontAgent) sendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	if !wa.lockSender() {
+		return nil
+	}
+	defer wa.senderMu.Unlock()
+	return wa.sendDeltaCounterLocked(name, value, source, tags)
+}
+
+// sendDeltaCounterLocked sends a single delta counter to Wavefront. The caller must hold senderMu.
+func (wa *WavefrontAgent) sendDeltaCounterLocked(name string, value float64, source string, tags map[string]string) error {
+	if !wa.metricEnabled(name) {
+		return nil
+	}
+	if wa.WavefrontConfig.CounterSource != "" {
+		source = wa.WavefrontConfig.CounterSource
+	}
+	tags = wa.compressTags(wa.transformTags(wa.capTags(tags)))
+	value = wa.transformValue(name, value)
+	for _, metricName := range wa.metricNames(name) {
+		err := wa.guard(func() error {
+			return wa.sendWithRetries(metricName, wa.WavefrontConfig.CounterSendRetries, func() error {
+				return wa.sender.SendDeltaCounter(metricName, value, source, tags)
+			})
+		})
+		if err != nil {
+			return err
+		}
+		if err := wa.pointSent(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendBatch calls send with a sender that can be used to send any number of points while senderMu is
+// held, so that a batch of points only acquires the lock once.
+func (wa *WavefrontAgent) sendBatch(send func(sender wavefront.MetricSender)) {
+	if !wa.lockSender() {
+		return
+	}
+	defer wa.senderMu.Unlock()
+	send(lockedSender{wa: wa})
+}
+
+// setTagRanks sets the ranks of the point tags of the invocation, which capTags uses to decide which
+// tags to drop.
+func (wa *WavefrontAgent) setTagRanks(ranks map[string]int) {
+	if !wa.lockSender() {
+		return
+	}
+	defer wa.senderMu.Unlock()
+	wa.tagRanks = ranks
+}
+
+// capTags returns tags with at most MaxPointTags tags, dropping the tags from the sources with the
+// lowest precedence first. The first time tags are dropped a warning is logged. The caller must hold
+// senderMu.
+func (wa *WavefrontAgent) capTags(tags map[string]string) map[string]string {
+	max := wa.WavefrontConfig.MaxPointTags
+	if max <= 0 {
+		max = defaultMaxPointTags
+	}
+	if len(tags) <= max {
+		return tags
+	}
+	if !wa.tagsCapped {
+		wa.tagsCapped = true
+		log.Printf("WARNING :: points have more than %d point tags, dropping the tags with the lowest precedence", max)
+	}
+	return capTags(tags, max, wa.tagRanks)
+}
+
+// transformValue returns value rescaled by the ValueTransform for the metric with the given name, or
+// value itself when there is none.
+func (wa *WavefrontAgent) transformValue(name string, value float64) float64 {
+	if transform, ok := wa.WavefrontConfig.ValueTransform[name]; ok && transform != nil {
+		return transform(value)
+	}
+	return value
+}
+
+// transformTags returns a new map with the tags rewritten by TagTransform, or the tags themselves when
+// TagTransform isn't set.
+func (wa *WavefrontAgent) transformTags(tags map[string]string) map[string]string {
+	if wa.WavefrontConfig.TagTransform == nil {
+		return tags
+	}
+	transformed := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if k, v = wa.WavefrontConfig.TagTransform(k, v); k != "" && v != "" {
+			transformed[k] = v
+		}
+	}
+	return transformed
+}
+
+// metricNames returns the names under which a metric is sent. Built-in metrics are sent once for
+// every prefix in MetricPrefixes, all other metrics are sent under their own name only.
+func (wa *WavefrontAgent) metricNames(name string) []string {
+	if len(wa.WavefrontConfig.MetricPrefixes) == 0 || !strings.HasPrefix(name, builtinPrefix) {
+		return []string{name}
+	}
+	names := make([]string, len(wa.WavefrontConfig.MetricPrefixes))
+	for i, prefix := range wa.WavefrontConfig.MetricPrefixes {
+		names[i] = prefix + strings.TrimPrefix(name, builtinPrefix)
+	}
+	return names
+}
+
+// pointSent records that a point was handed to the sender and flushes the sender once the number of
+// pending points reaches FlushAtPoints. The caller must hold senderMu.
+func (wa *WavefrontAgent) pointSent() error {
+	return wa.pointsSent(1)
+}
+
+// pointsSent is like pointSent for n points at once. The caller must hold senderMu.
+func (wa *WavefrontAgent) pointsSent(n int) error {
+	wa.pendingPoints += n
+	if wa.WavefrontConfig.FlushAtPoints <= 0 || wa.pendingPoints < wa.WavefrontConfig.FlushAtPoints {
+		return nil
+	}
+	wa.pendingPoints = 0
+	return wa.guard(wa.sender.Flush)
+}
+
+// Register adds a new Metric to be sent to Wavefront with the next invocation
+func (wa *WavefrontAgent) Register(m Metric) {
+	wa.metricsMu.Lock()
+	defer wa.metricsMu.Unlock()
+	if !wa.allowCustomMetric() {
+		return
+	}
+	wa.custom = append(wa.custom, m)
+}
+
+// send sends a single Metric to Wavefront through the agent and logs when that fails.
+func (wa *WavefrontAgent) send(m Metric, ts int64, source string, tags map[string]string) {
+	if err := m.Send(agentSender{wa: wa}, ts, source, tags); err != nil {
+		log.Printf("ERROR :: %s", err.Error())
+	}
+}
+
+// sendMetrics sends all registered metrics of the agent to Wavefront in a single batch. When the
+// sender is a BatchSender, they are sent to it in a single call.
+func (wa *WavefrontAgent) sendMetrics(ts int64, source string, tags map[string]string) {
+	if batchSender, ok := wa.sender.(BatchSender); ok {
+		if !wa.lockSender() {
+			return
+		}
+		defer wa.senderMu.Unlock()
+		c := &batchCollector{wa: wa}
+		wa.collectMetrics(c, ts, source, tags)
+		logError(wa.sendPoints(batchSender, c.points))
+		return
+	}
+	wa.sendBatch(func(sender wavefront.MetricSender) {
+		wa.collectMetrics(sender, ts, source, tags)
+	})
+}
+
+// collectMetrics sends all registered metrics and gauges of the agent through sender. The caller
+// must hold senderMu.
+func (wa *WavefrontAgent) collectMetrics(sender wavefront.MetricSender, ts int64, source string, tags map[string]string) {
+	for metricName, metricValue := range wa.metrics {
+		logError(Gauge{Name: metricName, Value: metricValue}.Send(sender, ts, source, tags))
+	}
+
+	wa.gaugesMu.Lock()
+	defer wa.gaugesMu.Unlock()
+	for metricName, metricValue := range wa.gauges {
+		logError(Gauge{Name: metricName, Value: metricValue}.Send(sender, ts, source, tags))
+	}
+}
+
+// sendCounters sends all registered counters of the agent to Wavefront in a single batch.
+func (wa *WavefrontAgent) sendCounters(source string, tags map[string]string) {
+	wa.sendBatch(func(sender wavefront.MetricSender) {
+		// Counters are deltas, so every value is only sent once. Custom counters that weren't
+		// registered again since then are skipped.
+		for metricName, metricValue := range wa.counters {
+			if metricValue == 0 && !strings.HasPrefix(metricName, builtinPrefix) {
+				continue
+			}
+			logError(DeltaCounter{Name: metricName, Value: metricValue}.Send(sender, 0, source, tags))
+			wa.counters[metricName] = 0
+		}
+
+		wa.deltaCountersMu.Lock()
+		defer wa.deltaCountersMu.Unlock()
+		for metricName, c := range wa.deltaCounters {
+			delta := c.reset()
+			if delta == 0 {
+				continue
+			}
+			if err := sender.SendDeltaCounter(metricName, delta, source, tags); err != nil {
+				log.Printf("ERROR :: %s", err.Error())
+				c.add(delta)
+			}
+		}
+	})
+}
+
+// sendCustom sends all Metrics registered with Register to Wavefront in a single batch, after which
+// they are forgotten, so each is only sent once. The caller must hold metricsMu.
+func (wa *WavefrontAgent) sendCustom(ts int64, source string, tags map[string]string) {
+	wa.sendBatch(func(sender wavefront.MetricSender) {
+		for _, m := range wa.custom {
+			logError(m.Send(sender, ts, source, tags))
+		}
+	})
+	wa.releaseCustomMetrics(len(wa.custom))
+	wa.custom = nil
+}
+
+// logError logs err, when it isn't nil.
+func logError(err error) {
+	if err != nil {
+		log.Printf("ERROR :: %s", err.Error())
+	}
+}
+
+// timestamp returns t as the timestamp of a metric, in epoch seconds or, when MillisecondTimestamps
+// is set, in epoch milliseconds.
+func (wa *WavefrontAgent) timestamp(t time.Time) int64 {
+	if wa.WavefrontConfig.MillisecondTimestamps {
+		return t.UnixNano() / int64(time.Millisecond)
+	}
+	return t.Unix()
+}
+
+// sendCanary sends the canary metric when CanaryInterval is set and at least that much time has passed
+// since it was last sent.
+func (wa *WavefrontAgent) sendCanary(now time.Time, source string, tags map[string]string) {
+	if wa.WavefrontConfig.CanaryInterval <= 0 || now.Sub(wa.lastCanary) < wa.WavefrontConfig.CanaryInterval {
+		return
+	}
+	wa.lastCanary = now
+	wa.send(Gauge{Name: "aws.lambda.wf.canary", Value: 1}, wa.timestamp(now), source, tags)
+}
+
+// sendContainerStarted sends the container started metric when ContainerStarted is set and it wasn't
+// sent before.
+func (wa *WavefrontAgent) sendContainerStarted(ts int64, source string, tags map[string]string) {
+	if !wa.WavefrontConfig.ContainerStarted {
+		return
+	}
+	wa.startedOnce.Do(func() {
+		startedTags := make(map[string]string, len(tags)+3)
+		for k, v := range tags {
+			startedTags[k] = v
+		}
+		startedTags["GoVersion"] = runtime.Version()
+		startedTags["Architecture"] = runtime.GOARCH
+		startedTags["MemorySize"] = strconv.Itoa(lambdacontext.MemoryLimitInMB)
+		wa.send(Gauge{Name: "aws.lambda.wf.container.started", Value: 1}, ts, source, startedTags)
+	})
+}
+
+// flush sends all buffered data of the sender of the agent to Wavefront.
+func (wa *WavefrontAgent) flush() error {
+	if !wa.lockSender() {
+		return nil
+	}
+	defer wa.senderMu.Unlock()
+	return wa.flushLocked()
+}
+
+// flushLocked is like flush. The caller must hold senderMu.
+func (wa *WavefrontAgent) flushLocked() error {
+	wa.pendingPoints = 0
+	wa.lastFlush = time.Now()
+	return wa.guard(wa.sender.Flush)
+}
+
+// flushDue returns whether at least the FlushInterval passed at now since the last flush, which is
+// when FlushOnErrorOnly flushes routine invocations.
+func (wa *WavefrontAgent) flushDue(now time.Time) bool {
+	interval := wa.WavefrontConfig.FlushInterval
+	if interval <= 0 {
+		interval = time.Duration(defaultFlushIntervalSeconds) * time.Second
+	}
+	if !wa.lockSender() {
+		return false
+	}
+	defer wa.senderMu.Unlock()
+	return now.Sub(wa.lastFlush) >= interval
+}
+
+// flushAndClose flushes and closes the sender, after which the invocation ends. sendStart is the time
+// at which the invocation started to send its data. While a flush abandoned by FlushTimeout still
+// runs, the data stays in the sender instead.
+func (wa *WavefrontAgent) flushAndClose(sendStart time.Time) {
+	defer wa.endInvocation()
+	if !wa.lockSender() {
+		log.Printf("WARNING :: an abandoned flush is still running, dropping the data of this invocation")
+		return
+	}
+	flushErr := wa.flushLocked()
+	closeErr := wa.guard(wa.sender.Close)
+	wa.senderMu.Unlock()
+
+	if flushErr != nil {
+		log.Printf("ERROR :: %s", flushErr.Error())
+	}
+	wa.closeError(closeErr)
+	wa.recordFlushDuration(sendStart)
+}
+
+// flushInBackground flushes and closes the sender in a new goroutine. The next invocation waits for it
+// in waitForBackgroundFlush.
+func (wa *WavefrontAgent) flushInBackground(sendStart time.Time) {
+	wa.backgroundFlush.Add(1)
+	go func() {
+		defer wa.backgroundFlush.Done()
+		wa.flushAndClose(sendStart)
+	}()
+}
+
+// flushWithTimeout flushes and closes the sender, but returns after timeout when that didn't complete
+// by then. The abandoned flush goes on in the background. While it runs, later invocations drop their
+// data instead of waiting for it, and Shutdown waits for it.
+func (wa *WavefrontAgent) flushWithTimeout(sendStart time.Time, timeout time.Duration) {
+	// Whoever comes first, the end of the flush or the timeout, sets ended, so that only a flush that
+	// was abandoned is counted in abandonedFlushes.
+	var ended int32
+	done := make(chan struct{})
+	wa.timedFlushes.Add(1)
+	go func() {
+		defer wa.timedFlushes.Done()
+		defer close(done)
+		wa.flushAndClose(sendStart)
+		if !atomic.CompareAndSwapInt32(&ended, 0, 1) {
+			atomic.AddInt32(&wa.abandonedFlushes, -1)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		if atomic.CompareAndSwapInt32(&ended, 0, 1) {
+			atomic.AddInt32(&wa.abandonedFlushes, 1)
+			log.Printf("WARNING :: flush didn't complete within %s, abandoning it", timeout)
+		}
+	}
+}
+
+// lockSender locks senderMu and returns true, unless a flush abandoned by FlushTimeout still runs. It
+// then returns false right away, so the data is dropped instead of waiting for that flush.
+func (wa *WavefrontAgent) lockSender() bool {
+	if atomic.LoadInt32(&wa.abandonedFlushes) > 0 {
+		return false
+	}
+	wa.senderMu.Lock()
+	return true
+}
+
+// recordFlushDuration keeps the time since start, at which the invocation started to send its data,
+// as the duration of the flush, to be sent with the next invocation.
+func (wa *WavefrontAgent) recordFlushDuration(start time.Time) {
+	if wa.WavefrontConfig.FlushDuration {
+		atomic.StoreInt64(&wa.flushDuration, int64(time.Since(start)))
+	}
+}
+
+// takeFlushDuration returns the duration of the flush of the previous invocation, and false when
+// there is none.
+func (wa *WavefrontAgent) takeFlushDuration() (time.Duration, bool) {
+	d := time.Duration(atomic.SwapInt64(&wa.flushDuration, 0))
+	return d, d > 0
+}
+
+// waitForBackgroundFlush waits until the flush of the previous invocation, if it was flushed in the
+// background, completed.
+func (wa *WavefrontAgent) waitForBackgroundFlush() {
+	wa.backgroundFlush.Wait()
+}
+
+// close closes the sender of the agent. An error is logged and passed to OnCloseError.
+func (wa *WavefrontAgent) close() {
+	if !wa.lockSender() {
+		return
+	}
+	err := wa.guard(wa.sender.Close)
+	wa.senderMu.Unlock()
+	wa.closeError(err)
+}
+
+// closeError logs err, when closing the sender failed, and passes it to OnCloseError.
+func (wa *WavefrontAgent) closeError(err error) {
+	if err != nil {
+		log.Printf("ERROR :: unable to close sender: %s", err.Error())
+		if wa.WavefrontConfig.OnCloseError != nil {
+			wa.WavefrontConfig.OnCloseError(err)
+		}
+	}
+}
+
+// resourcePointTags returns the AWS resource tags of the function that are in the allow-list of
+// ResourceTagKeys. The tags are fetched on the first call only and an error while fetching them is
+// logged, after which no resource tags are added.
+func (wa *WavefrontAgent) resourcePointTags(arn string) map[string]string {
+	wa.resourceTagsOnce.Do(func() {
+		wa.resourceTags = make(map[string]string)
+		if wa.WavefrontConfig.ResourceTags == nil || len(wa.WavefrontConfig.ResourceTagKeys) == 0 {
+			return
+		}
+
+		tags, err := wa.WavefrontConfig.ResourceTags(arn)
+		if err != nil {
+			log.Printf("ERROR :: unable to fetch resource tags: %s", err.Error())
+			return
+		}
+
+		for _, key := range wa.WavefrontConfig.ResourceTagKeys {
+			if value, ok := tags[key]; ok {
+				wa.resourceTags[key] = value
+			}
+		}
+	})
+	return wa.resourceTags
+}
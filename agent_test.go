@@ -1,9 +1,16 @@
 package wflambda
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -25,6 +32,7 @@ func TestAgent(t *testing.T) {
 	wa = NewWavefrontAgent(&WavefrontConfig{})
 	assert.NotNil(wa)
 	assert.Equal(wa.WavefrontConfig.Enabled, stringToBool("false"))
+	os.Unsetenv("WAVEFRONT_ENABLED")
 
 	str := "https://instance.wavefront.com"
 	wa = NewWavefrontAgent(&WavefrontConfig{Server: &str})
@@ -71,3 +79,554 @@ func TestAgent(t *testing.T) {
 	iface := wa.Wrapper("bla")
 	assert.Equal(iface.(string), "bla")
 }
+
+func TestAgentConcurrentFlush(t *testing.T) {
+	wa, fs := newTestAgent(&WavefrontConfig{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			wa.sendMetric("metric", float64(i), 0, "source", nil)
+			wa.sendDeltaCounter("counter", float64(i), "source", nil)
+			wa.flush()
+			wa.close()
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Contains(t, fs.metrics, "metric")
+	assert.Contains(t, fs.counters, "counter")
+}
+
+func TestAgentFlushAtPoints(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, fs := newTestAgent(&WavefrontConfig{FlushAtPoints: 3})
+	wa.sendMetric("metric1", 1, 0, "source", nil)
+	wa.sendDeltaCounter("counter1", 1, "source", nil)
+	assert.Equal(0, fs.flushes)
+	wa.sendMetric("metric2", 1, 0, "source", nil)
+	assert.Equal(1, fs.flushes)
+	wa.sendMetric("metric3", 1, 0, "source", nil)
+	wa.flush()
+	assert.Equal(2, fs.flushes)
+	wa.sendMetric("metric4", 1, 0, "source", nil)
+	wa.sendMetric("metric5", 1, 0, "source", nil)
+	assert.Equal(2, fs.flushes)
+
+	wa, fs = newTestAgent(&WavefrontConfig{})
+	for i := 0; i < 10; i++ {
+		wa.sendMetric("metric", 1, 0, "source", nil)
+	}
+	assert.Equal(0, fs.flushes)
+}
+
+func TestAgentResourceTags(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	wa, _ := newTestAgent(&WavefrontConfig{
+		ResourceTags: func(arn string) (map[string]string, error) {
+			calls++
+			return map[string]string{"team": "payments", "cost-center": "42", "secret": "shh"}, nil
+		},
+		ResourceTagKeys: []string{"team", "cost-center", "missing"},
+	})
+	tags := wa.resourcePointTags("arn")
+	assert.Equal(map[string]string{"team": "payments", "cost-center": "42"}, tags)
+	wa.resourcePointTags("arn")
+	assert.Equal(1, calls)
+
+	wa, _ = newTestAgent(&WavefrontConfig{
+		ResourceTags: func(arn string) (map[string]string, error) {
+			return nil, errors.New("access denied")
+		},
+		ResourceTagKeys: []string{"team"},
+	})
+	assert.Empty(wa.resourcePointTags("arn"))
+
+	wa, _ = newTestAgent(&WavefrontConfig{})
+	assert.Empty(wa.resourcePointTags("arn"))
+}
+
+func TestAgentMetricPrefixes(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{})
+	wa.sendMetric("aws.lambda.wf.duration", 1, 0, "source", nil)
+	_, ok := r.GetMetric("aws.lambda.wf.duration")
+	assert.True(ok)
+
+	wa, r = newTestAgent(&WavefrontConfig{MetricPrefixes: []string{"aws.lambda.wf.", "team.lambda."}})
+	wa.sendMetric("aws.lambda.wf.duration", 1, 0, "source", nil)
+	wa.sendDeltaCounter("aws.lambda.wf.invocations", 1, "source", nil)
+	wa.sendMetric("MeaningOfLife", 42, 0, "source", nil)
+	assert.Equal([]string{"aws.lambda.wf.duration", "team.lambda.duration", "aws.lambda.wf.invocations", "team.lambda.invocations", "MeaningOfLife"}, r.sent)
+}
+
+func TestAgentCanary(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	wa, r := newTestAgent(&WavefrontConfig{CanaryInterval: time.Minute})
+	wa.sendCanary(now, "source", nil)
+	wa.sendCanary(now.Add(30*time.Second), "source", nil)
+	assert.Equal([]string{"aws.lambda.wf.canary"}, r.sent)
+	value, _ := r.GetMetric("aws.lambda.wf.canary")
+	assert.Equal(float64(1), value)
+	wa.sendCanary(now.Add(time.Minute), "source", nil)
+	assert.Len(r.sent, 2)
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	wa.sendCanary(now, "source", nil)
+	assert.Empty(r.sent)
+}
+
+func TestAgentTagTransform(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{
+		TagTransform: func(key, value string) (string, string) {
+			if key == "secret" {
+				return "", ""
+			}
+			return strings.ToLower(key), strings.TrimPrefix(value, "team-")
+		},
+	})
+	tags := map[string]string{"Team": "team-payments", "secret": "shh"}
+	wa.sendMetric("metric", 1, 0, "source", tags)
+	wa.sendDeltaCounter("counter", 1, "source", tags)
+	assert.Equal(map[string]string{"team": "payments"}, r.GetTags())
+	assert.Equal("team-payments", tags["Team"])
+}
+
+func TestAgentValueTransform(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{
+		MetricPrefixes: []string{"custom."},
+		ValueTransform: map[string]func(float64) float64{
+			"aws.lambda.wf.mem.percentage": func(v float64) float64 { return v / 100 },
+			"aws.lambda.wf.errors":         func(v float64) float64 { return v * 2 },
+		},
+	})
+	wa.sendMetric("aws.lambda.wf.mem.percentage", 50, 0, "source", nil)
+	wa.sendMetric("aws.lambda.wf.mem.used", 50, 0, "source", nil)
+	wa.sendDeltaCounter("aws.lambda.wf.errors", 3, "source", nil)
+	value, _ := r.GetMetric("custom.mem.percentage")
+	assert.Equal(0.5, value)
+	value, _ = r.GetMetric("custom.mem.used")
+	assert.Equal(float64(50), value)
+	value, _ = r.GetCounter("custom.errors")
+	assert.Equal(float64(6), value)
+}
+
+func TestAgentMaxCustomMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{MaxCustomMetrics: 2})
+	wa.RegisterMetric("metric1", 1)
+	wa.RegisterCounter("counter1", 1)
+	wa.RegisterMetric("metric1", 2)
+	wa.RegisterMetric("metric2", 1)
+	wa.RegisterCounter("counter2", 1)
+	wa.Register(Gauge{Name: "gauge", Value: 1})
+	assert.Equal(float64(2), wa.metrics["metric1"])
+	assert.NotContains(wa.metrics, "metric2")
+	assert.NotContains(wa.counters, "counter2")
+	assert.Empty(wa.custom)
+
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	dropped, _ := r.GetCounter("aws.lambda.wf.custom_metrics_dropped")
+	assert.Equal(float64(3), dropped)
+
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	dropped, _ = r.GetCounter("aws.lambda.wf.custom_metrics_dropped")
+	assert.Equal(float64(3), dropped)
+}
+
+func TestAgentMaxCustomMetricsPerInvocation(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{MaxCustomMetrics: 2})
+	handler := NewHandlerWrapper(func() {
+		wa.Register(Gauge{Name: "gauge", Value: 1})
+	}, wa)
+	for i := 0; i < 5; i++ {
+		r.sent = nil
+		_, err := handler.Invoke(newTestContext(), nil)
+		assert.NoError(err)
+		assert.Contains(r.sent, "gauge")
+	}
+	_, ok := r.GetCounter("aws.lambda.wf.custom_metrics_dropped")
+	assert.False(ok)
+}
+
+func TestAgentContainerStarted(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{ContainerStarted: true})
+	tags := map[string]string{"FunctionName": "my-function"}
+	wa.sendContainerStarted(0, "source", tags)
+	wa.sendContainerStarted(0, "source", tags)
+	assert.Equal([]string{"aws.lambda.wf.container.started"}, r.sent)
+	assert.Equal(runtime.Version(), r.GetTags()["GoVersion"])
+	assert.Equal(runtime.GOARCH, r.GetTags()["Architecture"])
+	assert.Contains(r.GetTags(), "MemorySize")
+	assert.NotContains(tags, "GoVersion")
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	wa.sendContainerStarted(0, "source", tags)
+	assert.Empty(r.sent)
+}
+
+// flakySender is a Recorder that fails the given number of sends before it starts recording.
+type flakySender struct {
+	*Recorder
+	failures int
+}
+
+func (f *flakySender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("proxy unavailable")
+	}
+	return f.Recorder.SendMetric(name, value, ts, source, tags)
+}
+
+func (f *flakySender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("proxy unavailable")
+	}
+	return f.Recorder.SendDeltaCounter(name, value, source, tags)
+}
+
+func TestAgentCounterSendRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{CounterSendRetries: 2})
+	fs := &flakySender{Recorder: r, failures: 2}
+	wa.sender = fs
+	assert.NoError(wa.sendDeltaCounter("counter", 1, "source", nil))
+	_, ok := r.GetCounter("counter")
+	assert.True(ok)
+
+	fs.failures = 3
+	assert.Error(wa.sendDeltaCounter("counter", 1, "source", nil))
+
+	fs.failures = 1
+	assert.Error(wa.sendMetric("metric", 1, 0, "source", nil))
+	_, ok = r.GetMetric("metric")
+	assert.False(ok)
+}
+
+// newBenchmarkAgent returns an agent with the given number of metrics registered.
+func newBenchmarkAgent(metrics int) *WavefrontAgent {
+	wa, _ := newTestAgent(&WavefrontConfig{})
+	for i := 0; i < metrics; i++ {
+		wa.RegisterMetric(fmt.Sprintf("metric%d", i), float64(i))
+	}
+	return wa
+}
+
+func BenchmarkSendMetricsPerPoint(b *testing.B) {
+	wa := newBenchmarkAgent(50)
+	tags := map[string]string{"FunctionName": "my-function"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for name, value := range wa.metrics {
+			wa.send(Gauge{Name: name, Value: value}, 0, "source", tags)
+		}
+	}
+}
+
+func BenchmarkSendMetrics(b *testing.B) {
+	wa := newBenchmarkAgent(50)
+	tags := map[string]string{"FunctionName": "my-function"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wa.sendMetrics(0, "source", tags)
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1600000000, 123456789)
+	wa, _ := newTestAgent(&WavefrontConfig{})
+	assert.Equal(int64(1600000000), wa.timestamp(now))
+
+	wa, _ = newTestAgent(&WavefrontConfig{MillisecondTimestamps: true})
+	assert.Equal(int64(1600000000123), wa.timestamp(now))
+}
+
+// countingSender is a Sender that counts the calls it receives.
+type countingSender struct {
+	points, flushes, closes int
+}
+
+func (c *countingSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	c.points++
+	return nil
+}
+
+func (c *countingSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	c.points++
+	return nil
+}
+
+func (c *countingSender) Flush() error {
+	c.flushes++
+	return nil
+}
+
+func (c *countingSender) Close() error {
+	c.closes++
+	return nil
+}
+
+func TestAgentSender(t *testing.T) {
+	assert := assert.New(t)
+
+	cs := &countingSender{}
+	enabled := true
+	wa := NewWavefrontAgent(&WavefrontConfig{Enabled: &enabled, Sender: cs})
+	hw := NewHandlerWrapper(func() {}, wa)
+	_, err := hw.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.NotZero(cs.points)
+	assert.Equal(1, cs.flushes)
+	assert.Equal(1, cs.closes)
+
+	_, err = hw.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal(2, cs.flushes)
+	assert.Equal(2, cs.closes)
+}
+
+// sourceSender is a Recorder that keeps the sources of the metrics and counters it receives.
+type sourceSender struct {
+	*Recorder
+	metricSources  map[string]bool
+	counterSources map[string]bool
+}
+
+func (s *sourceSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	s.metricSources[source] = true
+	return s.Recorder.SendMetric(name, value, ts, source, tags)
+}
+
+func (s *sourceSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	s.counterSources[source] = true
+	return s.Recorder.SendDeltaCounter(name, value, source, tags)
+}
+
+func TestAgentSources(t *testing.T) {
+	assert := assert.New(t)
+
+	lambdacontext.FunctionName = "my-function"
+	defer func() { lambdacontext.FunctionName = "" }()
+
+	for _, tc := range []struct {
+		config         *WavefrontConfig
+		metricSources  map[string]bool
+		counterSources map[string]bool
+	}{
+		{&WavefrontConfig{}, map[string]bool{"my-function": true}, map[string]bool{"my-function": true}},
+		{&WavefrontConfig{CounterSource: "checkout"}, map[string]bool{"my-function": true}, map[string]bool{"checkout": true}},
+		{&WavefrontConfig{MetricSource: "checkout"}, map[string]bool{"checkout": true}, map[string]bool{"my-function": true}},
+	} {
+		wa, r := newTestAgent(tc.config)
+		s := &sourceSender{Recorder: r, metricSources: make(map[string]bool), counterSources: make(map[string]bool)}
+		wa.sender = s
+		_, err := NewHandlerWrapper(func() error {
+			wa.RegisterMetric("work", 1)
+			wa.RegisterCounter("items", 1)
+			return errors.New("failed")
+		}, wa).Invoke(newTestContext(), nil)
+		assert.Error(err)
+		assert.Equal(tc.metricSources, s.metricSources)
+		assert.Equal(tc.counterSources, s.counterSources)
+		assert.Equal("my-function", r.GetTags()["source"])
+	}
+}
+
+func TestAgentDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	cs := &countingSender{}
+	wa := NewWavefrontAgent(WithEnabled(false), WithSender(cs))
+	assert.Nil(wa.sender)
+	handler := func() (string, error) { return "response", errors.New("failed") }
+	response, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.Equal("response", response)
+	assert.EqualError(err, "failed")
+	assert.Zero(cs.points)
+	assert.Zero(cs.flushes)
+	assert.Zero(cs.closes)
+
+	os.Setenv("WAVEFRONT_ENABLED", "false")
+	defer os.Unsetenv("WAVEFRONT_ENABLED")
+	wa = NewWavefrontAgent(WithEnabled(true), WithSender(cs))
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Zero(cs.points)
+	assert.Zero(cs.flushes)
+	assert.Zero(cs.closes)
+}
+
+func TestAgentRegisterDeltaCounter(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{})
+	c := wa.RegisterDeltaCounter("orders.processed")
+	assert.Same(c, wa.RegisterDeltaCounter("orders.processed"))
+
+	handler := func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.Increment(2)
+			}()
+		}
+		wg.Wait()
+	}
+	hw := NewHandlerWrapper(handler, wa)
+	_, err := hw.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	value, ok := r.GetCounter("orders.processed")
+	assert.True(ok)
+	assert.Equal(float64(20), value)
+	assert.Equal("my-function", r.GetTags()["Resource"])
+
+	// The delta starts from zero after it was sent, and zero deltas aren't sent
+	_, err = hw.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	value, _ = r.GetCounter("orders.processed")
+	assert.Equal(float64(40), value)
+
+	r.counters = make(map[string]float64)
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetCounter("orders.processed")
+	assert.False(ok)
+
+	// Counters beyond MaxCustomMetrics aren't sent
+	wa, r = newTestAgent(&WavefrontConfig{MaxCustomMetrics: 1})
+	wa.RegisterDeltaCounter("first").Increment(1)
+	wa.RegisterDeltaCounter("second").Increment(1)
+	wa.sendCounters("source", nil)
+	_, ok = r.GetCounter("first")
+	assert.True(ok)
+	_, ok = r.GetCounter("second")
+	assert.False(ok)
+}
+
+// closeErrorSender is a Recorder whose Close fails.
+type closeErrorSender struct {
+	*Recorder
+}
+
+func (c *closeErrorSender) Close() error {
+	return errors.New("connection reset")
+}
+
+func TestAgentCloseError(t *testing.T) {
+	assert := assert.New(t)
+
+	var closeErrs []error
+	wa, r := newTestAgent(&WavefrontConfig{OnCloseError: func(err error) { closeErrs = append(closeErrs, err) }})
+	wa.sender = &closeErrorSender{Recorder: r}
+	_, err := NewHandlerWrapper(func() error { return nil }, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Len(closeErrs, 1)
+	assert.EqualError(closeErrs[0], "connection reset")
+
+	// The panic of the handler is still passed on
+	assert.PanicsWithValue("boom", func() {
+		NewHandlerWrapper(func() { panic("boom") }, wa).Invoke(newTestContext(), nil)
+	})
+	assert.Len(closeErrs, 2)
+
+	// Without OnCloseError the error is only logged
+	wa.WavefrontConfig.OnCloseError = nil
+	_, err = NewHandlerWrapper(func() error { return nil }, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+}
+
+func TestAgentSetGauge(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{MaxCustomMetrics: 2})
+	assert.NoError(wa.SetGauge("queue.depth", 10))
+	assert.NoError(wa.SetGauge("queue.depth", 4))
+	assert.NoError(wa.SetGauge("cache.hit_ratio", 0.9))
+	assert.Error(wa.SetGauge("aws.lambda.wf.duration", 1))
+	assert.Error(wa.SetGauge("workers", 3))
+
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	value, ok := r.GetMetric("queue.depth")
+	assert.True(ok)
+	assert.Equal(float64(4), value)
+	value, _ = r.GetMetric("cache.hit_ratio")
+	assert.Equal(0.9, value)
+	_, ok = r.GetMetric("workers")
+	assert.False(ok)
+	value, _ = r.GetMetric("aws.lambda.wf.duration")
+	assert.NotEqual(float64(1), value)
+}
+
+func TestWrapHandlerE(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{})
+	for _, tc := range []struct {
+		handler interface{}
+		err     string
+	}{
+		{nil, "handler is nil"},
+		{"handler", "handler kind string is not func"},
+		{func(a, b, c int) {}, "handlers may not take more than two arguments, but handler takes 3"},
+		{func(a, b int) {}, "handler takes two arguments, but the first is not Context. got int"},
+		{func() (int, int) { return 0, 0 }, "handler returns two values, but the second does not implement error"},
+		{func() int { return 0 }, "handler returns a single value, but it does not implement error"},
+	} {
+		handler, err := WrapHandlerE(tc.handler, wa)
+		assert.EqualError(err, tc.err)
+		assert.Nil(handler)
+	}
+	_, ok := r.GetCounter("aws.lambda.wf.invocations")
+	assert.False(ok)
+
+	type order struct {
+		Quantity int `json:"quantity"`
+	}
+	handler, err := WrapHandlerE(func(o order) (int, error) { return o.Quantity * 2, nil }, wa)
+	assert.NoError(err)
+	response, err := handler.Invoke(newTestContext(), []byte(`{"quantity":3}`))
+	assert.NoError(err)
+	assert.Equal("6", string(response))
+	invocations, ok := r.GetCounter("aws.lambda.wf.invocations")
+	assert.True(ok)
+	assert.Equal(float64(1), invocations)
+
+	enabled := false
+	wa = NewWavefrontAgent(&WavefrontConfig{Enabled: &enabled})
+	_, err = WrapHandlerE(func() int { return 0 }, wa)
+	assert.Error(err)
+	handler, err = WrapHandlerE(func() (string, error) { return "ok", nil }, wa)
+	assert.NoError(err)
+	response, err = handler.Invoke(newTestContext(), []byte(`{}`))
+	assert.NoError(err)
+	assert.Equal(`"ok"`, string(response))
+}
@@ -0,0 +1,73 @@
+package wflambda
+
+// MetricPoint is a single metric point, as sent to a BatchSender.
+type MetricPoint struct {
+	Name      string
+	Value     float64
+	Timestamp int64
+	Source    string
+	Tags      map[string]string
+}
+
+// BatchSender is implemented by senders that can send many metrics in a single call, like in one
+// request. The agent then sends the metrics and gauges of an invocation to SendMetrics at once
+// instead of calling SendMetric for each of them.
+type BatchSender interface {
+	// SendMetrics sends all points. When it fails, the points may be sent again.
+	SendMetrics(points []MetricPoint) error
+}
+
+// metricPoints returns the points that are sent for the metric with the given name, after applying
+// the configuration of the agent, like the MetricSource and MetricPrefixes. It returns nil for
+// metrics that aren't enabled. The caller must hold senderMu.
+func (wa *WavefrontAgent) metricPoints(name string, value float64, ts int64, source string, tags map[string]string) []MetricPoint {
+	if !wa.metricEnabled(name) {
+		return nil
+	}
+	if wa.WavefrontConfig.MetricSource != "" {
+		source = wa.WavefrontConfig.MetricSource
+	}
+	tags = wa.compressTags(wa.transformTags(wa.capTags(tags)))
+	value = wa.transformValue(name, value)
+	names := wa.metricNames(name)
+	points := make([]MetricPoint, len(names))
+	for i, metricName := range names {
+		points[i] = MetricPoint{Name: metricName, Value: value, Timestamp: ts, Source: source, Tags: tags}
+	}
+	return points
+}
+
+// batchCollector is a wavefront.MetricSender that collects the metric points sent to it, so they can
+// be sent to a BatchSender at once. Delta counters are sent through the agent right away. The caller
+// must hold the senderMu of the agent.
+type batchCollector struct {
+	wa     *WavefrontAgent
+	points []MetricPoint
+}
+
+// SendMetric collects the points of a single metric.
+func (c *batchCollector) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	c.points = append(c.points, c.wa.metricPoints(name, value, ts, source, tags)...)
+	return nil
+}
+
+// SendDeltaCounter sends a single delta counter through the agent.
+func (c *batchCollector) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	return c.wa.sendDeltaCounterLocked(name, value, source, tags)
+}
+
+// sendPoints sends the points to sender in a single call. The caller must hold senderMu.
+func (wa *WavefrontAgent) sendPoints(sender BatchSender, points []MetricPoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+	err := wa.guard(func() error {
+		return wa.sendWithRetries("batch of metrics", 0, func() error {
+			return sender.SendMetrics(points)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return wa.pointsSent(len(points))
+}
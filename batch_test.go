@@ -0,0 +1,84 @@
+package wflambda
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// batchRecorder is a Recorder that is a BatchSender, and counts the calls to SendMetrics.
+type batchRecorder struct {
+	*Recorder
+	batches  int
+	failures int
+}
+
+func (b *batchRecorder) SendMetrics(points []MetricPoint) error {
+	b.batches++
+	if b.failures > 0 {
+		b.failures--
+		return errors.New("batch failed")
+	}
+	for _, p := range points {
+		b.Recorder.SendMetric(p.Name, p.Value, p.Timestamp, p.Source, p.Tags)
+	}
+	return nil
+}
+
+func (b *batchRecorder) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	return errors.New("metrics must be sent in a batch")
+}
+
+func TestInvokeBatchSender(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{
+		MetricPrefixes: []string{"aws.lambda.wf.", "team.lambda."},
+		RetryPolicy:    &RetryPolicy{MaxAttempts: 2},
+	})
+	br := &batchRecorder{Recorder: r, failures: 1}
+	wa.sender = br
+	_, err := NewHandlerWrapper(func() {
+		wa.RegisterMetric("orders", 3)
+		assert.NoError(wa.SetGauge("queue.depth", 7))
+	}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+
+	assert.Equal(2, br.batches)
+	for _, name := range []string{"aws.lambda.wf.duration", "team.lambda.duration", "aws.lambda.wf.mem.used", "team.lambda.mem.total"} {
+		_, ok := r.GetMetric(name)
+		assert.True(ok, name)
+	}
+	orders, ok := r.GetMetric("orders")
+	assert.True(ok)
+	assert.Equal(float64(3), orders)
+	depth, ok := r.GetMetric("queue.depth")
+	assert.True(ok)
+	assert.Equal(float64(7), depth)
+	invocations, ok := r.GetCounter("aws.lambda.wf.invocations")
+	assert.True(ok)
+	assert.Equal(float64(1), invocations)
+}
+
+// newBatchBenchmarkAgent returns an agent with a BatchSender and the given number of metrics
+// registered.
+func newBatchBenchmarkAgent(metrics int) *WavefrontAgent {
+	wa, r := newTestAgent(&WavefrontConfig{})
+	wa.sender = &batchRecorder{Recorder: r}
+	for i := 0; i < metrics; i++ {
+		wa.RegisterMetric(fmt.Sprintf("metric%d", i), float64(i))
+	}
+	return wa
+}
+
+func BenchmarkSendMetricsBatch(b *testing.B) {
+	wa := newBatchBenchmarkAgent(50)
+	tags := map[string]string{"FunctionName": "my-function"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wa.sendMetrics(0, "source", tags)
+	}
+}
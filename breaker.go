@@ -0,0 +1,61 @@
+package wflambda
+
+import (
+	"log"
+	"time"
+)
+
+// CircuitBreaker configures the circuit breaker that stops sending data to Wavefront while it keeps
+// failing, so an outage of Wavefront doesn't slow down every invocation.
+type CircuitBreaker struct {
+	// Number of consecutive failed operations on the sender after which the breaker opens. Defaults
+	// to 1.
+	FailureThreshold int
+	// Time the breaker stays open, during which nothing is sent. After it, the next operation probes
+	// whether Wavefront recovered: when it succeeds the breaker closes, when it fails the breaker
+	// opens for another Cooldown.
+	Cooldown time.Duration
+}
+
+// breaker is the state of the CircuitBreaker of an agent, guarded by senderMu.
+type breaker struct {
+	failures  int
+	open      bool
+	openUntil time.Time
+}
+
+// guard calls op, which is an operation on the sender, unless the CircuitBreaker is open, in which
+// case op is skipped and nil is returned. The result of op updates the breaker. The caller must hold
+// senderMu.
+func (wa *WavefrontAgent) guard(op func() error) error {
+	cb := wa.WavefrontConfig.CircuitBreaker
+	if cb == nil {
+		return op()
+	}
+	if wa.breaker.open && time.Now().Before(wa.breaker.openUntil) {
+		return nil
+	}
+
+	err := op()
+	if err == nil {
+		if wa.breaker.open {
+			log.Printf("WARNING :: circuit breaker closed, sending data to Wavefront again")
+		}
+		wa.breaker = breaker{}
+		return nil
+	}
+
+	wa.breaker.failures++
+	threshold := cb.FailureThreshold
+	if threshold <= 0 {
+		threshold = 1
+	}
+	if wa.breaker.open || wa.breaker.failures >= threshold {
+		if !wa.breaker.open {
+			log.Printf("WARNING :: circuit breaker opened after %d failures, skipping sends for %s", wa.breaker.failures, cb.Cooldown)
+		}
+		wa.breaker.open = true
+		wa.breaker.openUntil = time.Now().Add(cb.Cooldown)
+	}
+	return err
+}
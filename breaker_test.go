@@ -0,0 +1,79 @@
+package wflambda
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// outageSender is a Recorder that fails all operations while down, and counts the calls it gets.
+type outageSender struct {
+	*Recorder
+	down  bool
+	calls int
+}
+
+func (o *outageSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	o.calls++
+	if o.down {
+		return errors.New("proxy unavailable")
+	}
+	return o.Recorder.SendMetric(name, value, ts, source, tags)
+}
+
+func (o *outageSender) Flush() error {
+	o.calls++
+	if o.down {
+		return errors.New("proxy unavailable")
+	}
+	return o.Recorder.Flush()
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{CircuitBreaker: &CircuitBreaker{FailureThreshold: 2, Cooldown: 20 * time.Millisecond}})
+	outage := &outageSender{Recorder: r, down: true}
+	wa.sender = outage
+
+	assert.Error(wa.sendMetric("metric", 1, 0, "source", nil))
+	assert.False(wa.breaker.open)
+	assert.Error(wa.flush())
+	assert.True(wa.breaker.open)
+
+	// An open breaker skips all operations
+	assert.NoError(wa.sendMetric("metric", 1, 0, "source", nil))
+	assert.NoError(wa.flush())
+	assert.Equal(2, outage.calls)
+
+	// After the cooldown a failed probe opens the breaker again
+	time.Sleep(25 * time.Millisecond)
+	assert.Error(wa.sendMetric("metric", 1, 0, "source", nil))
+	assert.True(wa.breaker.open)
+	assert.NoError(wa.sendMetric("metric", 1, 0, "source", nil))
+	assert.Equal(3, outage.calls)
+
+	// A successful probe closes it
+	outage.down = false
+	time.Sleep(25 * time.Millisecond)
+	assert.NoError(wa.sendMetric("metric", 1, 0, "source", nil))
+	assert.False(wa.breaker.open)
+	_, ok := r.GetMetric("metric")
+	assert.True(ok)
+	assert.NoError(wa.sendMetric("other", 1, 0, "source", nil))
+	assert.Equal(5, outage.calls)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{})
+	outage := &outageSender{Recorder: r, down: true}
+	wa.sender = outage
+	for i := 0; i < 5; i++ {
+		assert.Error(wa.sendMetric("metric", 1, 0, "source", nil))
+	}
+	assert.Equal(5, outage.calls)
+}
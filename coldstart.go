@@ -0,0 +1,16 @@
+package wflambda
+
+import "time"
+
+// initTime is the time at which the package was initialized, which is close to the start of the
+// container.
+var initTime = time.Now()
+
+// sendColdStartDuration sends the time from initTime until the cold start invocation started at
+// invokeTime, when ColdStartDuration is set. It must only be called for the cold start invocation.
+func (wa *WavefrontAgent) sendColdStartDuration(invokeTime time.Time, ts int64, source string, tags map[string]string) {
+	if !wa.WavefrontConfig.ColdStartDuration {
+		return
+	}
+	wa.send(Gauge{Name: "aws.lambda.wf.coldstart.duration_ms", Value: invokeTime.Sub(initTime).Seconds() * 1000}, ts, source, tags)
+}
@@ -0,0 +1,38 @@
+package wflambda
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvokeColdStartDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	setColdStart(t, true)
+	wa, r := newTestAgent(&WavefrontConfig{ColdStartDuration: true})
+	handler := NewHandlerWrapper(func() {}, wa)
+	for i := 0; i < 3; i++ {
+		_, err := handler.Invoke(newTestContext(), nil)
+		assert.NoError(err)
+	}
+	duration, ok := r.GetMetric("aws.lambda.wf.coldstart.duration_ms")
+	assert.True(ok)
+	assert.True(duration > 0)
+	assert.True(duration <= time.Since(initTime).Seconds()*1000)
+	sent := 0
+	for _, name := range r.sent {
+		if name == "aws.lambda.wf.coldstart.duration_ms" {
+			sent++
+		}
+	}
+	assert.Equal(1, sent)
+
+	setColdStart(t, true)
+	wa, r = newTestAgent(&WavefrontConfig{})
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetMetric("aws.lambda.wf.coldstart.duration_ms")
+	assert.False(ok)
+}
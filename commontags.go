@@ -0,0 +1,51 @@
+package wflambda
+
+// CommonTagsSender is implemented by senders that can attach a set of common point tags to every
+// point they send, so the tags don't have to be repeated for each point. Tags that are passed with a
+// point take precedence over the common tags with the same key.
+type CommonTagsSender interface {
+	// SetCommonTags replaces the common point tags attached to every point sent after it.
+	SetCommonTags(tags map[string]string)
+}
+
+// compressTags returns the tags that have to be sent with a point when CommonTags is set and the
+// sender is a CommonTagsSender. These are the tags that aren't in the registered common tags, or that
+// have a different value there. When the point doesn't have all of the common tags, its tags are
+// registered as the new common tags instead. In all other cases tags is returned as is. The caller
+// must hold senderMu.
+func (wa *WavefrontAgent) compressTags(tags map[string]string) map[string]string {
+	sender, ok := wa.sender.(CommonTagsSender)
+	if !ok || !wa.WavefrontConfig.CommonTags {
+		return tags
+	}
+
+	if wa.commonTags == nil || !hasAllTags(tags, wa.commonTags) {
+		wa.commonTags = make(map[string]string, len(tags))
+		for k, v := range tags {
+			wa.commonTags[k] = v
+		}
+		sender.SetCommonTags(wa.commonTags)
+		return nil
+	}
+
+	var specific map[string]string
+	for k, v := range tags {
+		if common, ok := wa.commonTags[k]; !ok || common != v {
+			if specific == nil {
+				specific = make(map[string]string)
+			}
+			specific[k] = v
+		}
+	}
+	return specific
+}
+
+// hasAllTags reports whether tags has all keys of common.
+func hasAllTags(tags map[string]string, common map[string]string) bool {
+	for k := range common {
+		if _, ok := tags[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
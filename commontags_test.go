@@ -0,0 +1,97 @@
+package wflambda
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// commonTagsSender is a Recorder that supports common tags and counts the bytes of the point tags a
+// sender would have to write for each point.
+type commonTagsSender struct {
+	*Recorder
+	common    map[string]string
+	tags      []map[string]string
+	tagsBytes int
+}
+
+func (c *commonTagsSender) SetCommonTags(tags map[string]string) {
+	c.common = tags
+	c.countTags(tags)
+}
+
+func (c *commonTagsSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	c.tags = append(c.tags, tags)
+	c.countTags(tags)
+	return c.Recorder.SendMetric(name, value, ts, source, tags)
+}
+
+func (c *commonTagsSender) countTags(tags map[string]string) {
+	for k, v := range tags {
+		c.tagsBytes += len(k) + len(v) + 4
+	}
+}
+
+func TestAgentCommonTags(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{CommonTags: true})
+	cs := &commonTagsSender{Recorder: r}
+	wa.sender = cs
+	tags := map[string]string{"FunctionName": "my-function", "Region": "us-west-2"}
+
+	wa.sendMetric("metric1", 1, 0, "source", tags)
+	assert.Equal(tags, cs.common)
+	assert.Empty(cs.tags[0])
+
+	wa.sendMetric("metric2", 1, 0, "source", tags)
+	assert.Empty(cs.tags[1])
+
+	wa.sendMetric("metric3", 1, 0, "source", map[string]string{"FunctionName": "my-function", "Region": "eu-west-1", "phase": "init"})
+	assert.Equal(map[string]string{"Region": "eu-west-1", "phase": "init"}, cs.tags[2])
+	assert.Equal(tags, cs.common)
+
+	// Points without all common tags register their own tags as the new common tags
+	wa.sendMetric("metric4", 1, 0, "source", map[string]string{"FunctionName": "my-function"})
+	assert.Equal(map[string]string{"FunctionName": "my-function"}, cs.common)
+	assert.Empty(cs.tags[3])
+
+	// Without CommonTags, or with a sender that doesn't support them, all tags are sent
+	wa, r = newTestAgent(&WavefrontConfig{})
+	cs = &commonTagsSender{Recorder: r}
+	wa.sender = cs
+	wa.sendMetric("metric1", 1, 0, "source", tags)
+	assert.Equal(tags, cs.tags[0])
+	assert.Nil(cs.common)
+
+	wa, r = newTestAgent(&WavefrontConfig{CommonTags: true})
+	wa.sendMetric("metric1", 1, 0, "source", tags)
+	assert.Equal(tags, r.GetTags())
+}
+
+// benchmarkCommonTags sends the metrics of an agent with the given CommonTags setting, and reports the
+// bytes of point tags per batch.
+func benchmarkCommonTags(b *testing.B, commonTags bool) {
+	wa := newBenchmarkAgent(50)
+	wa.WavefrontConfig.CommonTags = commonTags
+	cs := &commonTagsSender{Recorder: wa.sender.(*Recorder)}
+	wa.sender = cs
+	tags := ParseARNTags("arn:aws:lambda:us-west-2:123456789012:function:my-function")
+	tags["FunctionName"] = "my-function"
+	tags["ExecutedVersion"] = "$LATEST"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cs.tags = cs.tags[:0]
+		wa.sendMetrics(0, "source", tags)
+	}
+	b.ReportMetric(float64(cs.tagsBytes)/float64(b.N), "tag-bytes/op")
+}
+
+func BenchmarkSendMetricsAllTags(b *testing.B) {
+	benchmarkCommonTags(b, false)
+}
+
+func BenchmarkSendMetricsCommonTags(b *testing.B) {
+	benchmarkCommonTags(b, true)
+}
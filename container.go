@@ -0,0 +1,37 @@
+package wflambda
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// containerID is a random ID of the container, generated when the package is initialized.
+var containerID = newContainerID()
+
+// newContainerID returns a random 16 character hex ID. When no random bytes are available it falls
+// back to the time, which is still unique enough to tell containers apart.
+func newContainerID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// sendContainerRegistered sends the container registered metric, tagged with the ID of the
+// container, when ContainerRegistration is set and it wasn't sent before.
+func (wa *WavefrontAgent) sendContainerRegistered(ts int64, source string, tags map[string]string) {
+	if !wa.WavefrontConfig.ContainerRegistration {
+		return
+	}
+	wa.registeredOnce.Do(func() {
+		registeredTags := make(map[string]string, len(tags)+1)
+		for k, v := range tags {
+			registeredTags[k] = v
+		}
+		registeredTags["ContainerID"] = containerID
+		wa.send(Gauge{Name: "aws.lambda.wf.container.registered", Value: 1}, ts, source, registeredTags)
+	})
+}
@@ -0,0 +1,48 @@
+package wflambda
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainerID(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Len(containerID, 16)
+	assert.NotEqual(containerID, newContainerID())
+}
+
+func TestInvokeContainerRegistration(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{ContainerRegistration: true})
+	cs := &commonTagsSender{Recorder: r}
+	wa.sender = cs
+	hw := NewHandlerWrapper(func() {}, wa)
+	for i := 0; i < 2; i++ {
+		_, err := hw.Invoke(newTestContext(), nil)
+		assert.NoError(err)
+	}
+
+	registered := 0
+	for _, name := range r.sent {
+		if name == "aws.lambda.wf.container.registered" {
+			registered++
+		}
+	}
+	assert.Equal(1, registered)
+	// Only the registration metric carries the ContainerID tag
+	withID := 0
+	for _, tags := range cs.tags {
+		if tags["ContainerID"] == containerID {
+			withID++
+		}
+	}
+	assert.Equal(1, withID)
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.NotContains(r.GetTags(), "ContainerID")
+}
@@ -0,0 +1,104 @@
+package wflambda
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// invocationKey is the key under which the invocation state is stored in the context passed to the
+// wrapped handler.
+type invocationKey struct{}
+
+// invocation holds the state of a single invocation that the handler can influence while it runs.
+type invocation struct {
+	mu          sync.Mutex
+	forceSample bool
+	logger      *log.Logger
+	logLines    int
+	tags        map[string]string
+}
+
+// newInvocationContext returns a copy of ctx that carries a fresh invocation state, together with
+// that state.
+func newInvocationContext(ctx context.Context) (context.Context, *invocation) {
+	inv := &invocation{}
+	return context.WithValue(ctx, invocationKey{}, inv), inv
+}
+
+// invocationFromContext returns the invocation state stored in ctx, or nil when ctx was not created
+// by the wrapper.
+func invocationFromContext(ctx context.Context) *invocation {
+	if ctx == nil {
+		return nil
+	}
+	inv, _ := ctx.Value(invocationKey{}).(*invocation)
+	return inv
+}
+
+// ForceSample guarantees that the metrics of the current invocation are sent to Wavefront, regardless
+// of the configured sample rate. It must be called with the context passed to the handler and is a
+// no-op outside of a wrapped handler.
+func ForceSample(ctx context.Context) {
+	inv := invocationFromContext(ctx)
+	if inv == nil {
+		return
+	}
+	inv.mu.Lock()
+	inv.forceSample = true
+	inv.mu.Unlock()
+}
+
+// SetOperation sets the name of the logical operation the handler performs in the current invocation.
+// The name is sent as the Operation point tag on the metrics of this invocation, so it should come
+// from a small, fixed, set of values. It must be called with the context passed to the handler and
+// is a no-op outside of a wrapped handler.
+func SetOperation(ctx context.Context, operation string) {
+	inv := invocationFromContext(ctx)
+	if inv == nil {
+		return
+	}
+	inv.setTag("Operation", operation)
+}
+
+// setTag sets a point tag that only applies to the metrics of this invocation.
+func (inv *invocation) setTag(key string, value string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if inv.tags == nil {
+		inv.tags = make(map[string]string)
+	}
+	inv.tags[key] = value
+}
+
+// pointTags returns a copy of the point tags that were set for this invocation.
+func (inv *invocation) pointTags() map[string]string {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	tags := make(map[string]string, len(inv.tags))
+	for k, v := range inv.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// sampled reports whether the metrics of this invocation should be sent given the sample rate.
+func (inv *invocation) sampled(sampleRate float64, random float64) bool {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.forceSample || random < sampleRate
+}
+
+// forced reports whether the handler called ForceSample for this invocation.
+func (inv *invocation) forced() bool {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.forceSample
+}
+
+// lines returns the number of lines the handler wrote through the invocation logger.
+func (inv *invocation) lines() int {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.logLines
+}
@@ -0,0 +1,41 @@
+package wflambda
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForceSample(t *testing.T) {
+	assert := assert.New(t)
+
+	// Calling ForceSample outside of the wrapper is a no-op
+	ForceSample(context.Background())
+	assert.Nil(invocationFromContext(context.Background()))
+
+	ctx, inv := newInvocationContext(context.Background())
+	assert.Equal(inv, invocationFromContext(ctx))
+	assert.True(inv.sampled(0.5, 0.1))
+	assert.False(inv.sampled(0.5, 0.9))
+	assert.False(inv.sampled(0, 0))
+
+	ForceSample(ctx)
+	assert.True(inv.sampled(0, 0.9))
+}
+
+func TestSetOperation(t *testing.T) {
+	assert := assert.New(t)
+
+	// Calling SetOperation outside of the wrapper is a no-op
+	SetOperation(context.Background(), "process_payment")
+
+	ctx, inv := newInvocationContext(context.Background())
+	assert.Empty(inv.pointTags())
+
+	SetOperation(ctx, "process_payment")
+	tags := inv.pointTags()
+	assert.Equal("process_payment", tags["Operation"])
+	tags["Operation"] = "changed"
+	assert.Equal("process_payment", inv.pointTags()["Operation"])
+}
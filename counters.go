@@ -1,11 +1,57 @@
 package wflambda
 
-// counter is a struct to count values
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// counter is a struct to count values, which is safe to use from multiple goroutines
 type counter struct {
-	val float64
+	val int64
 }
 
 // Increment updates the value of a counter with the given value
 func (c *counter) Increment(value int64) {
+	atomic.AddInt64(&c.val, value)
+}
+
+// value returns the value of the counter
+func (c *counter) value() float64 {
+	return float64(atomic.LoadInt64(&c.val))
+}
+
+// take returns the value of the counter and resets it to zero, so the next call returns the delta
+// since this one
+func (c *counter) take() float64 {
+	return float64(atomic.SwapInt64(&c.val, 0))
+}
+
+// Counter is a delta counter that can be incremented from any goroutine. Its value is sent with the
+// counters of the invocation, after which it starts again from zero.
+type Counter struct {
+	mu  sync.Mutex
+	val float64
+}
+
+// Increment adds value to the counter.
+func (c *Counter) Increment(value int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.val += float64(value)
 }
+
+// reset returns the value of the counter and sets it to zero.
+func (c *Counter) reset() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	val := c.val
+	c.val = 0
+	return val
+}
+
+// add adds value back to the counter, when sending it failed.
+func (c *Counter) add(value float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.val += value
+}
@@ -12,7 +12,7 @@ func TestCounters(t *testing.T) {
 	ctr := counter{}
 	assert.NotNil(ctr)
 	ctr.Increment(2)
-	assert.Equal(ctr.val, float64(2))
+	assert.Equal(ctr.value(), float64(2))
 	ctr.Increment(-3)
-	assert.Equal(ctr.val, float64(-1))
+	assert.Equal(ctr.value(), float64(-1))
 }
@@ -0,0 +1,36 @@
+package wflambda
+
+import (
+	"os"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// cpuTimes contains the CPU time consumed by the process, in seconds.
+type cpuTimes struct {
+	User   float64
+	System float64
+}
+
+// getCPUTimes retrieves the user and system CPU time consumed by the process so far. It returns false
+// when CPU accounting isn't available on the platform.
+func getCPUTimes() (*cpuTimes, bool) {
+	p, err := process.NewProcess(int32(os.Getpid()))
+	if err != nil {
+		return nil, false
+	}
+	times, err := p.Times()
+	if err != nil {
+		return nil, false
+	}
+	return &cpuTimes{User: times.User, System: times.System}, true
+}
+
+// cpuTimes returns the CPU times through the readCPUTimes function of the agent, or getCPUTimes when
+// it has none.
+func (wa *WavefrontAgent) cpuTimes() (*cpuTimes, bool) {
+	if wa.readCPUTimes != nil {
+		return wa.readCPUTimes()
+	}
+	return getCPUTimes()
+}
@@ -0,0 +1,76 @@
+package wflambda
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCPUTimes(t *testing.T) {
+	assert := assert.New(t)
+
+	times, ok := getCPUTimes()
+	if runtime.GOOS != "linux" && !ok {
+		t.Skip("CPU accounting isn't available on", runtime.GOOS)
+	}
+	assert.True(ok)
+	assert.True(times.User >= 0)
+	assert.True(times.System >= 0)
+}
+
+func TestInvokeCPUTime(t *testing.T) {
+	assert := assert.New(t)
+
+	if _, ok := getCPUTimes(); !ok {
+		t.Skip("CPU accounting isn't available on", runtime.GOOS)
+	}
+	handler := func() {
+		x := 0
+		for i := 0; i < 50000000; i++ {
+			x += i
+		}
+		_ = x
+	}
+	wa, r := newTestAgent(&WavefrontConfig{CPUTime: true})
+	_, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	user, ok := r.GetMetric("aws.lambda.wf.cpu.user")
+	assert.True(ok)
+	assert.True(user >= 0)
+	system, ok := r.GetMetric("aws.lambda.wf.cpu.system")
+	assert.True(ok)
+	assert.True(system >= 0)
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	_, err = NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetMetric("aws.lambda.wf.cpu.user")
+	assert.False(ok)
+}
+
+func TestInvokeCPUTimeUnavailable(t *testing.T) {
+	assert := assert.New(t)
+
+	available := true
+	wa, r := newTestAgent(&WavefrontConfig{CPUTime: true})
+	wa.readCPUTimes = func() (*cpuTimes, bool) {
+		if !available {
+			return nil, false
+		}
+		return &cpuTimes{User: 1, System: 2}, true
+	}
+	handler := NewHandlerWrapper(func() {}, wa)
+	_, err := handler.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok := r.GetMetric("aws.lambda.wf.cpu.user")
+	assert.True(ok)
+
+	// The CPU times of the previous invocation aren't sent again.
+	available = false
+	r.sent = nil
+	_, err = handler.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.NotContains(r.sent, "aws.lambda.wf.cpu.user")
+	assert.NotContains(r.sent, "aws.lambda.wf.cpu.system")
+}
@@ -0,0 +1,40 @@
+package wflambda
+
+import "strings"
+
+// metricSet returns the names as a set, or nil when names is empty so that all metrics are enabled.
+func metricSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// metricEnabled returns whether the metric or counter with the given name is sent. Custom metrics are
+// always sent, and built-in metrics when they are in the EnabledMetrics or EnabledMetrics is empty.
+func (wa *WavefrontAgent) metricEnabled(name string) bool {
+	if wa.enabledMetrics == nil || !strings.HasPrefix(name, builtinPrefix) {
+		return true
+	}
+	return wa.enabledMetrics[name]
+}
+
+// setBuiltinMetric sets the value of the built-in metric with the given name for this invocation,
+// unless it isn't enabled. The caller must hold metricsMu.
+func (wa *WavefrontAgent) setBuiltinMetric(name string, value float64) {
+	if wa.metricEnabled(name) {
+		wa.metrics[name] = value
+	}
+}
+
+// setBuiltinCounter sets the delta of the built-in counter with the given name for this invocation,
+// unless it isn't enabled. The caller must hold metricsMu.
+func (wa *WavefrontAgent) setBuiltinCounter(name string, value float64) {
+	if wa.metricEnabled(name) {
+		wa.counters[name] = value
+	}
+}
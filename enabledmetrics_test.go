@@ -0,0 +1,60 @@
+package wflambda
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvokeEnabledMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{EnabledMetrics: []string{
+		"aws.lambda.wf.duration",
+		"aws.lambda.wf.invocations",
+		"aws.lambda.wf.coldstarts",
+		"aws.lambda.wf.errors",
+	}})
+	_, err := NewHandlerWrapper(func() error { return errors.New("failed") }, wa).Invoke(newTestContext(), nil)
+	assert.Error(err)
+	for _, name := range []string{"aws.lambda.wf.mem.total", "aws.lambda.wf.mem.used", "aws.lambda.wf.mem.percentage"} {
+		_, ok := r.GetMetric(name)
+		assert.False(ok, name)
+		_, ok = wa.metrics[name]
+		assert.False(ok, name)
+	}
+	_, ok := r.GetMetric("aws.lambda.wf.coldstart")
+	assert.False(ok)
+	_, ok = r.GetMetric("aws.lambda.wf.duration")
+	assert.True(ok)
+	invocations, ok := r.GetCounter("aws.lambda.wf.invocations")
+	assert.True(ok)
+	assert.Equal(float64(1), invocations)
+	_, ok = r.GetCounter("aws.lambda.wf.coldstarts")
+	assert.True(ok)
+	errs, ok := r.GetCounter("aws.lambda.wf.errors")
+	assert.True(ok)
+	assert.Equal(float64(1), errs)
+
+	// Custom metrics are always sent.
+	wa, r = newTestAgent(&WavefrontConfig{EnabledMetrics: []string{"aws.lambda.wf.duration"}})
+	_, err = NewHandlerWrapper(func() { wa.RegisterMetric("orders", 3) }, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetMetric("orders")
+	assert.True(ok)
+	_, ok = r.GetCounter("aws.lambda.wf.invocations")
+	assert.False(ok)
+}
+
+func TestMetricEnabled(t *testing.T) {
+	assert := assert.New(t)
+
+	wa := &WavefrontAgent{}
+	assert.True(wa.metricEnabled("aws.lambda.wf.mem.used"))
+	wa.enabledMetrics = metricSet([]string{"aws.lambda.wf.duration"})
+	assert.True(wa.metricEnabled("aws.lambda.wf.duration"))
+	assert.False(wa.metricEnabled("aws.lambda.wf.mem.used"))
+	assert.True(wa.metricEnabled("orders"))
+	assert.Nil(metricSet(nil))
+}
@@ -0,0 +1,26 @@
+package wflambda
+
+import "regexp"
+
+// ErrorPattern classifies error messages that match Pattern as Name.
+type ErrorPattern struct {
+	// Name is the value of the ErrorPattern point tag for errors that match. Keep the number of
+	// distinct names small, as every name creates new time series in Wavefront.
+	Name string
+	// Pattern is matched against the message of the error.
+	Pattern *regexp.Regexp
+}
+
+// otherErrorPattern is the value of the ErrorPattern point tag for errors that match no pattern.
+const otherErrorPattern = "other"
+
+// matchErrorPattern returns the name of the first pattern that matches message, or other when none
+// matches.
+func matchErrorPattern(patterns []ErrorPattern, message string) string {
+	for _, p := range patterns {
+		if p.Pattern != nil && p.Pattern.MatchString(message) {
+			return p.Name
+		}
+	}
+	return otherErrorPattern
+}
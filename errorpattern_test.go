@@ -0,0 +1,44 @@
+package wflambda
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchErrorPattern(t *testing.T) {
+	assert := assert.New(t)
+
+	patterns := []ErrorPattern{
+		{Name: "conn_refused", Pattern: regexp.MustCompile("connection refused")},
+		{Name: "timeout", Pattern: regexp.MustCompile(`(?i)timed? ?out`)},
+		{Name: "any_dial", Pattern: regexp.MustCompile("^dial")},
+		{Name: "nil_pattern"},
+	}
+	assert.Equal("conn_refused", matchErrorPattern(patterns, "dial tcp 10.0.0.1:5432: connection refused"))
+	assert.Equal("timeout", matchErrorPattern(patterns, "request Timed out"))
+	assert.Equal("any_dial", matchErrorPattern(patterns, "dial tcp: lookup db: no such host"))
+	assert.Equal("other", matchErrorPattern(patterns, "out of stock"))
+	assert.Equal("other", matchErrorPattern(nil, "out of stock"))
+}
+
+func TestInvokeErrorPattern(t *testing.T) {
+	assert := assert.New(t)
+
+	patterns := []ErrorPattern{{Name: "conn_refused", Pattern: regexp.MustCompile("connection refused")}}
+	wa, r := newTestAgent(&WavefrontConfig{ErrorPatterns: patterns})
+	_, err := NewHandlerWrapper(func() error { return errors.New("dial tcp: connection refused") }, wa).Invoke(newTestContext(), nil)
+	assert.Error(err)
+	assert.Equal("conn_refused", r.GetTags()["ErrorPattern"])
+
+	_, err = NewHandlerWrapper(func() error { return errors.New("out of stock") }, wa).Invoke(newTestContext(), nil)
+	assert.Error(err)
+	assert.Equal("other", r.GetTags()["ErrorPattern"])
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	_, err = NewHandlerWrapper(func() error { return errors.New("dial tcp: connection refused") }, wa).Invoke(newTestContext(), nil)
+	assert.Error(err)
+	assert.NotContains(r.GetTags(), "ErrorPattern")
+}
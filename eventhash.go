@@ -0,0 +1,31 @@
+package wflambda
+
+import (
+	"encoding/json"
+	"hash/fnv"
+)
+
+// eventHashBucket hashes the payload, or only its top-level field with the given name when field isn't
+// empty, into one of the given number of buckets. It returns false as second value when the payload
+// can't be hashed, like when it doesn't have the field.
+func eventHashBucket(payload interface{}, field string, buckets int) (int, bool) {
+	value := payload
+	if field != "" {
+		event, ok := payload.(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		if value, ok = event[field]; !ok {
+			return 0, false
+		}
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return 0, false
+	}
+
+	h := fnv.New32a()
+	h.Write(b)
+	return int(h.Sum32() % uint32(buckets)), true
+}
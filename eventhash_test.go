@@ -0,0 +1,41 @@
+package wflambda
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventHashBucket(t *testing.T) {
+	assert := assert.New(t)
+
+	event := map[string]interface{}{"id": "order-1", "amount": 42}
+	bucket, ok := eventHashBucket(event, "", 8)
+	assert.True(ok)
+	assert.True(bucket >= 0 && bucket < 8)
+
+	again, _ := eventHashBucket(map[string]interface{}{"id": "order-1", "amount": 42}, "", 8)
+	assert.Equal(bucket, again)
+
+	idBucket, ok := eventHashBucket(event, "id", 8)
+	assert.True(ok)
+	other, _ := eventHashBucket(map[string]interface{}{"id": "order-1", "amount": 7}, "id", 8)
+	assert.Equal(idBucket, other)
+
+	_, ok = eventHashBucket(event, "missing", 8)
+	assert.False(ok)
+	_, ok = eventHashBucket("not an object", "id", 8)
+	assert.False(ok)
+}
+
+func TestInvokeEventHash(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{EventHashBuckets: 4, EventHashField: "id"})
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), map[string]interface{}{"id": "order-1"})
+	assert.NoError(err)
+	value, _ := r.GetCounter("aws.lambda.wf.event_hash")
+	assert.Equal(float64(1), value)
+	assert.Contains(r.GetTags(), "EventHashBucket")
+	assert.NotContains(wa.PointTags, "EventHashBucket")
+}
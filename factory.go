@@ -0,0 +1,154 @@
+package wflambda
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// AgentFactory creates agents for different handlers in the same binary that share one configuration
+// and one sender.
+//
+// Shared by all agents of a factory are the configuration, which is resolved once from the options
+// and environment variables, and the sender, so there is a single connection to Wavefront. Each agent
+// gets its own copy of the WavefrontConfig, including its PointTags. The cold start of the container
+// is shared too: only the first invocation of any handler is a cold start.
+//
+// Isolated per agent are the cold start, invocation, and error counters, the custom metrics,
+// counters, delta counters, and gauges, and the per-invocation state like the memory peak and the
+// canary. The data of one handler is never sent by the agent of another handler.
+type AgentFactory struct {
+	config *WavefrontConfig
+	sender Sender
+	// agentsMu guards agents, the agents created by NewAgent.
+	agentsMu sync.Mutex
+	agents   []*WavefrontAgent
+}
+
+// NewAgentFactory returns a factory for agents configured by opts, the same way NewWavefrontAgent
+// configures a single agent. With ShutdownOnSIGTERM, the factory calls Shutdown once for all its
+// agents when the process receives SIGTERM.
+func NewAgentFactory(opts ...Option) *AgentFactory {
+	w := newConfig(opts)
+	sender, err := resolveConfig(w, nil)
+	if err != nil {
+		log.Printf("ERROR :: %s", err.Error())
+	}
+
+	f := &AgentFactory{config: w}
+	if sender != nil {
+		f.sender = &sharedSender{sender: sender}
+	}
+	if *w.Enabled && w.ShutdownOnSIGTERM {
+		f.shutdownOnSIGTERM()
+	}
+	return f
+}
+
+// NewAgent returns a new agent that shares the configuration and sender of the factory, with its own
+// counters and metrics. It is safe to call concurrently.
+func (f *AgentFactory) NewAgent() *WavefrontAgent {
+	config := *f.config
+	config.PointTags = make(map[string]string, len(f.config.PointTags))
+	for k, v := range f.config.PointTags {
+		config.PointTags[k] = v
+	}
+	wa := newAgent(&config, f.sender)
+
+	f.agentsMu.Lock()
+	f.agents = append(f.agents, wa)
+	f.agentsMu.Unlock()
+	return wa
+}
+
+// Shutdown waits up to ShutdownGracePeriod for the in-flight invocations of all agents of the factory
+// to finish, and then flushes, closes, and stops the shared sender, after which none of the agents
+// can send anymore. It returns false when invocations were still in flight after the grace period.
+func (f *AgentFactory) Shutdown() bool {
+	f.agentsMu.Lock()
+	agents := append([]*WavefrontAgent(nil), f.agents...)
+	f.agentsMu.Unlock()
+
+	deadline := time.Now().Add(f.config.ShutdownGracePeriod)
+	drained := true
+	for _, wa := range agents {
+		drained = wa.drain(deadline) && drained
+	}
+	if f.sender == nil {
+		return drained
+	}
+
+	if err := f.sender.Flush(); err != nil {
+		log.Printf("ERROR :: %s", err.Error())
+	}
+	if err := f.sender.Close(); err != nil {
+		log.Printf("ERROR :: unable to close sender: %s", err.Error())
+		if f.config.OnCloseError != nil {
+			f.config.OnCloseError(err)
+		}
+	}
+	f.sender.(stopper).Stop()
+	return drained
+}
+
+// shutdownOnSIGTERM calls Shutdown when the process receives SIGTERM.
+func (f *AgentFactory) shutdownOnSIGTERM() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	go func() {
+		<-signals
+		f.Shutdown()
+	}()
+}
+
+// sharedSender serializes the operations of the agents of a factory on their shared sender. It
+// isn't a CommonTagsSender, because the common tags of the agents differ, so all tags are sent with
+// each point.
+type sharedSender struct {
+	mu     sync.Mutex
+	sender Sender
+	// Whether the shared sender was stopped.
+	stopped bool
+}
+
+// SendMetric sends a single metric through the shared sender.
+func (s *sharedSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sender.SendMetric(name, value, ts, source, tags)
+}
+
+// SendDeltaCounter sends a single delta counter through the shared sender.
+func (s *sharedSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sender.SendDeltaCounter(name, value, source, tags)
+}
+
+// Flush flushes the shared sender.
+func (s *sharedSender) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sender.Flush()
+}
+
+// Close closes the shared sender.
+func (s *sharedSender) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sender.Close()
+}
+
+// Stop stops the shared sender when it has to be stopped for good. Only the first call stops it, as
+// each agent of the factory may be shut down.
+func (s *sharedSender) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stopper, ok := s.sender.(stopper); ok && !s.stopped {
+		stopper.Stop()
+	}
+	s.stopped = true
+}
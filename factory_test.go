@@ -0,0 +1,99 @@
+package wflambda
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// operationSender sums the deltas sent for each counter per Operation point tag.
+type operationSender struct {
+	*Recorder
+	mu     sync.Mutex
+	deltas map[string]map[string]float64
+}
+
+func (o *operationSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	o.mu.Lock()
+	if o.deltas[tags["Operation"]] == nil {
+		o.deltas[tags["Operation"]] = make(map[string]float64)
+	}
+	o.deltas[tags["Operation"]][name] += value
+	o.mu.Unlock()
+	return o.Recorder.SendDeltaCounter(name, value, source, tags)
+}
+
+func TestAgentFactory(t *testing.T) {
+	assert := assert.New(t)
+
+	_, r := newTestAgent(&WavefrontConfig{})
+	ops := &operationSender{Recorder: r, deltas: make(map[string]map[string]float64)}
+	enabled := true
+	f := NewAgentFactory(&WavefrontConfig{Enabled: &enabled}, WithSender(ops), WithPointTag("team", "payments"))
+
+	a := f.NewAgent()
+	b := f.NewAgent()
+	assert.True(a.WavefrontConfig != b.WavefrontConfig)
+	assert.Equal(a.PointTags, b.PointTags)
+	assert.Same(a.sender, b.sender)
+
+	handlerA := wrapHandler(func(ctx context.Context) error {
+		SetOperation(ctx, "a")
+		a.RegisterCounter("items", 2)
+		return errors.New("failed")
+	}, a)
+	handlerB := wrapHandler(func(ctx context.Context) error {
+		SetOperation(ctx, "b")
+		b.RegisterCounter("items", 5)
+		return nil
+	}, b)
+
+	for i := 0; i < 2; i++ {
+		_, err := handlerA(newTestContext(), nil)
+		assert.Error(err)
+	}
+	_, err := handlerB(newTestContext(), nil)
+	assert.NoError(err)
+
+	assert.Equal(float64(2), ops.deltas["a"]["aws.lambda.wf.invocations"])
+	assert.Equal(float64(1), ops.deltas["b"]["aws.lambda.wf.invocations"])
+	assert.NotZero(ops.deltas["a"]["aws.lambda.wf.errors"])
+	assert.Zero(ops.deltas["b"]["aws.lambda.wf.errors"])
+	assert.Equal(float64(4), ops.deltas["a"]["items"])
+	assert.Equal(float64(5), ops.deltas["b"]["items"])
+	assert.Equal("payments", r.GetTags()["team"])
+}
+
+func TestAgentFactoryNewAgentConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	_, r := newTestAgent(&WavefrontConfig{})
+	enabled := true
+	f := NewAgentFactory(&WavefrontConfig{Enabled: &enabled, ShutdownOnSIGTERM: true}, WithSender(r), WithPointTag("team", "payments"))
+
+	agents := make([]*WavefrontAgent, 10)
+	var wg sync.WaitGroup
+	for i := range agents {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			agents[i] = f.NewAgent()
+			agents[i].PointTags["agent"] = string(rune('a' + i))
+		}(i)
+	}
+	wg.Wait()
+
+	for i, wa := range agents {
+		assert.Equal("payments", wa.PointTags["team"])
+		assert.Equal(string(rune('a'+i)), wa.PointTags["agent"])
+		assert.Same(agents[0].sender, wa.sender)
+	}
+	assert.NotContains(f.config.PointTags, "agent")
+
+	assert.True(f.Shutdown())
+	assert.Equal(1, r.flushes)
+	assert.True(f.sender.(*sharedSender).stopped)
+}
@@ -0,0 +1,36 @@
+//go:build go1.21
+// +build go1.21
+
+package wflambda
+
+import "context"
+
+// WrapHandlerFunc wraps a handler whose event and response types are known at compile time, like
+//
+//	lambda.Start(wflambda.WrapHandlerFunc(handler, wfAgent))
+//
+// for a handler func(context.Context, events.SQSEvent) (string, error). The Lambda runtime decodes the
+// event into In, and the handler is called without reflection. It sends the same metrics as Wrapper.
+// A ResponseInterceptor has to return an Out, or else the zero value of Out is returned. When the
+// agent is disabled, the handler is returned as is.
+//
+// WrapHandlerFunc needs Go 1.21 or later, the first release in which the build constraint of a file
+// raises its language version above the go 1.12 of the module.
+func WrapHandlerFunc[In, Out any](handler func(context.Context, In) (Out, error), wa *WavefrontAgent) func(context.Context, In) (Out, error) {
+	if !*wa.Enabled {
+		return handler
+	}
+
+	hw := &HandlerWrapper{
+		wavefrontAgent: wa,
+		wrappedHandler: func(ctx context.Context, payload interface{}) (interface{}, error) {
+			event, _ := payload.(In)
+			return handler(ctx, event)
+		},
+	}
+	return func(ctx context.Context, event In) (Out, error) {
+		response, err := hw.Invoke(ctx, event)
+		out, _ := response.(Out)
+		return out, err
+	}
+}
@@ -0,0 +1,63 @@
+//go:build go1.21
+// +build go1.21
+
+package wflambda
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testOrder struct {
+	ID       string `json:"id"`
+	Quantity int    `json:"quantity"`
+}
+
+func TestWrapHandlerFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{})
+	handler := WrapHandlerFunc(func(ctx context.Context, o testOrder) (int, error) {
+		if o.Quantity == 0 {
+			return 0, errors.New("empty order")
+		}
+		return o.Quantity * 2, nil
+	}, wa)
+
+	total, err := handler(newTestContext(), testOrder{ID: "o-1", Quantity: 3})
+	assert.NoError(err)
+	assert.Equal(6, total)
+	_, ok := r.GetMetric("aws.lambda.wf.duration")
+	assert.True(ok)
+	_, ok = r.GetMetric("aws.lambda.wf.mem.used")
+	assert.True(ok)
+	invocations, ok := r.GetCounter("aws.lambda.wf.invocations")
+	assert.True(ok)
+	assert.Equal(float64(1), invocations)
+
+	total, err = handler(newTestContext(), testOrder{ID: "o-2"})
+	assert.EqualError(err, "empty order")
+	assert.Equal(0, total)
+	errs, ok := r.GetCounter("aws.lambda.wf.errors")
+	assert.True(ok)
+	assert.Equal(float64(1), errs)
+}
+
+func TestWrapHandlerFuncDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	enabled := false
+	wa := NewWavefrontAgent(&WavefrontConfig{Enabled: &enabled})
+	called := false
+	handler := WrapHandlerFunc(func(ctx context.Context, o testOrder) (string, error) {
+		called = true
+		return o.ID, nil
+	}, wa)
+	id, err := handler(context.Background(), testOrder{ID: "o-1"})
+	assert.NoError(err)
+	assert.Equal("o-1", id)
+	assert.True(called)
+}
@@ -5,8 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
+	"os"
 	"reflect"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambdacontext"
@@ -17,16 +22,14 @@ type lambdaHandler func(context.Context, interface{}) (interface{}, error)
 
 // wrapHandler decorates the handler with the handler wrapper
 func wrapHandler(handler interface{}, wa *WavefrontAgent) lambdaHandler {
-	return func(context context.Context, payload interface{}) (interface{}, error) {
-		handlerWrapper := NewHandlerWrapper(handler, wa)
-		return handlerWrapper.Invoke(context, payload)
-	}
+	handlerWrapper := NewHandlerWrapper(handler, wa)
+	return handlerWrapper.Invoke
 }
 
-// HandlerWrapper is the Wavefront Agent handler wrapper
+// HandlerWrapper is the Wavefront Agent handler wrapper. It holds no state of an invocation, so a
+// single wrapper is used for all invocations, including concurrent ones.
 type HandlerWrapper struct {
 	wavefrontAgent *WavefrontAgent
-	lambdaContext  *lambdacontext.LambdaContext
 	wrappedHandler lambdaHandler
 }
 
@@ -35,107 +38,574 @@ type HandlerWrapper struct {
 func NewHandlerWrapper(handler interface{}, wa *WavefrontAgent) *HandlerWrapper {
 	return &HandlerWrapper{
 		wavefrontAgent: wa,
-		wrappedHandler: newHandler(handler),
+		wrappedHandler: newHandler(handler, wa.WavefrontConfig.StrictContext),
 	}
 }
 
 // Invoke calls the handler, and serializes the response.
 // If the underlying handler returned an error, or an error occurs during serialization, error is returned.
 func (hw *HandlerWrapper) Invoke(ctx context.Context, payload interface{}) (response interface{}, err error) {
+	// A disabled agent has no sender, so the handler runs without instrumentation
+	if !*hw.wavefrontAgent.WavefrontConfig.Enabled {
+		return hw.wrappedHandler(ctx, payload)
+	}
+
+	// Start timer for the work of the wrapper itself
+	invokeTime := time.Now()
+
+	// Make sure the data of the previous invocation was flushed before sending new data
+	hw.wavefrontAgent.waitForBackgroundFlush()
+
+	// The time until the deadline at the start of the invocation is the timeout of the function
+	deadline, hasDeadline := ctx.Deadline()
+
 	// Get the lambda context
 	lc, _ := lambdacontext.FromContext(ctx)
-	hw.lambdaContext = lc
 
 	// Get the point tags
-	invokedFunctionArn := hw.lambdaContext.InvokedFunctionArn
-	splitArn := strings.Split(invokedFunctionArn, ":")
-
-	// Expected formats for Lambda ARN are:
-	// https://docs.aws.amazon.com/general/latest/gr/aws-arns-and-namespaces.html#arn-syntax-lambda
-	hw.wavefrontAgent.WavefrontConfig.PointTags["LambdaArn"] = invokedFunctionArn
-	hw.wavefrontAgent.WavefrontConfig.PointTags["source"] = lambdacontext.FunctionName
-	hw.wavefrontAgent.WavefrontConfig.PointTags["FunctionName"] = lambdacontext.FunctionName
-	hw.wavefrontAgent.WavefrontConfig.PointTags["ExecutedVersion"] = lambdacontext.FunctionVersion
-	hw.wavefrontAgent.WavefrontConfig.PointTags["Region"] = splitArn[3]
-	hw.wavefrontAgent.WavefrontConfig.PointTags["accountId"] = splitArn[4]
+	invokedFunctionArn := ""
+	if lc != nil {
+		invokedFunctionArn = lc.InvokedFunctionArn
+	}
+	// Only send data to Wavefront from the allowed regions
+	if !regionAllowed(hw.wavefrontAgent.WavefrontConfig.RegionAllowList, functionRegion(invokedFunctionArn)) {
+		return hw.wrappedHandler(ctx, payload)
+	}
 
-	if splitArn[5] == "function" {
-		hw.wavefrontAgent.WavefrontConfig.PointTags["Resource"] = splitArn[6]
-		if len(splitArn) == 8 {
-			hw.wavefrontAgent.WavefrontConfig.PointTags["Resource"] += ":" + splitArn[7]
+	tagSources := map[TagSource]map[string]string{
+		TagSourceConfig: hw.wavefrontAgent.configPointTags(),
+		TagSourceFunction: {
+			"source":          lambdacontext.FunctionName,
+			"FunctionName":    lambdacontext.FunctionName,
+			"ExecutedVersion": lambdacontext.FunctionVersion,
+		},
+		TagSourceResource: hw.wavefrontAgent.resourcePointTags(invokedFunctionArn),
+	}
+	if hw.wavefrontAgent.WavefrontConfig.RequestIDTag && lc != nil && lc.AwsRequestID != "" {
+		tagSources[TagSourceFunction]["RequestId"] = lc.AwsRequestID
+	}
+	if invokedFunctionArn != "" {
+		parseARN := ParseARNTags
+		if parser := hw.wavefrontAgent.WavefrontConfig.ARNParser; parser != nil {
+			parseARN = parser
 		}
-	} else if splitArn[5] == "event-source-mappings" {
-		hw.wavefrontAgent.WavefrontConfig.PointTags["EventSourceMappings"] = splitArn[6]
+		tagSources[TagSourceARN] = parseARN(invokedFunctionArn)
+	} else {
+		fallbackTags := make(map[string]string)
+		for k, v := range hw.wavefrontAgent.WavefrontConfig.FallbackTags {
+			if _, ok := hw.wavefrontAgent.WavefrontConfig.PointTags[k]; !ok {
+				fallbackTags[k] = v
+			}
+		}
+		tagSources[TagSourceARN] = fallbackTags
+	}
+	if hw.wavefrontAgent.WavefrontConfig.VpcTags {
+		tagSources[TagSourceVpc] = vpcTags()
+	}
+	if hw.wavefrontAgent.WavefrontConfig.StageFromAlias {
+		if stage := parseStage(invokedFunctionArn); stage != "" {
+			tagSources[TagSourceStage] = map[string]string{"Stage": stage}
+		}
+	}
+
+	// Errors during the cold start invocation are attributed to the initialization of the function
+	isColdStart := atomic.CompareAndSwapInt32(&coldStart, 1, 0)
+
+	// Create the invocation state the handler can interact with through its context
+	ctx, inv := newInvocationContext(ctx)
+	invocationPointTags := func() map[string]string {
+		tagSources[TagSourceInvocation] = inv.pointTags()
+		tags, ranks := mergeTags(hw.wavefrontAgent.WavefrontConfig.TagPrecedence, tagSources)
+		hw.wavefrontAgent.setTagRanks(ranks)
+		return tags
 	}
 
+	// Track the invocation as in flight until all its data is handed to the sender.
+	hw.wavefrontAgent.startInvocation()
+
+	// Time at which the invocation started to send its data, for FlushDuration.
+	var sendStart time.Time
+	// Error the handler signaled in its response, for ResponseErrorPath.
+	var responseErr string
+	// Whether the flush is skipped for a routine invocation, for FlushOnErrorOnly.
+	var skipFlush bool
+
 	// Defer a function to send error details to Wavefront in case an error occurs during invocation of the function.
 	defer func() {
+		if sendStart.IsZero() {
+			sendStart = time.Now()
+			hw.wavefrontAgent.startRetryBudget()
+		}
 		var deferedErr interface{}
 		if e := recover(); e != nil {
 			deferedErr = e
-			errCounter.Increment(1)
-			hw.wavefrontAgent.sender.SendDeltaCounter("aws.lambda.wf.errors", errCounter.val, lambdacontext.FunctionName, hw.wavefrontAgent.WavefrontConfig.PointTags)
+			// Panics are counted apart from the errors the handler returned
+			tags := hw.errorPatternTag(errorPointTags(invocationPointTags(), isColdStart), fmt.Sprint(e))
+			tags["PanicStack"] = panicStack(debug.Stack(), maxPanicStackLength)
+			hw.wavefrontAgent.sendDeltaCounter("aws.lambda.wf.panics", 1, lambdacontext.FunctionName, tags)
 		} else if err != nil {
-			errCounter.Increment(1)
-			hw.wavefrontAgent.sender.SendDeltaCounter("aws.lambda.wf.errors", errCounter.val, lambdacontext.FunctionName, hw.wavefrontAgent.WavefrontConfig.PointTags)
+			hw.wavefrontAgent.errCounter.Increment(1)
+			tags := hw.errorPatternTag(errorPointTags(invocationPointTags(), isColdStart), err.Error())
+			if _, ok := err.(*deserializationError); ok {
+				tags["errorType"] = "deserialization"
+				hw.wavefrontAgent.sendDeltaCounter("aws.lambda.wf.deserialization_errors", 1, lambdacontext.FunctionName, tags)
+			}
+			hw.wavefrontAgent.sendDeltaCounter("aws.lambda.wf.errors", hw.wavefrontAgent.errCounter.take(), lambdacontext.FunctionName, tags)
+		} else if responseErr != "" {
+			hw.wavefrontAgent.errCounter.Increment(1)
+			tags := hw.errorPatternTag(errorPointTags(invocationPointTags(), isColdStart), responseErr)
+			tags["errorType"] = "response"
+			hw.wavefrontAgent.sendDeltaCounter("aws.lambda.wf.errors", hw.wavefrontAgent.errCounter.take(), lambdacontext.FunctionName, tags)
 		}
 
-		hw.wavefrontAgent.sender.Flush()
-		hw.wavefrontAgent.sender.Close()
+		if skipFlush && deferedErr == nil {
+			hw.wavefrontAgent.endInvocation()
+		} else if hw.wavefrontAgent.WavefrontConfig.BackgroundFlush && deferedErr == nil {
+			hw.wavefrontAgent.flushInBackground(sendStart)
+		} else if timeout := hw.wavefrontAgent.WavefrontConfig.FlushTimeout; timeout > 0 {
+			hw.wavefrontAgent.flushWithTimeout(sendStart, timeout)
+		} else {
+			hw.wavefrontAgent.flushAndClose(sendStart)
+		}
 
 		if deferedErr != nil {
-			panic(deferedErr)
+			if hw.wavefrontAgent.WavefrontConfig.OnPanic == nil && !hw.wavefrontAgent.WavefrontConfig.RecoverPanics {
+				panic(deferedErr)
+			}
+			log.Printf("ERROR :: handler panicked: %v", deferedErr)
+			err = fmt.Errorf("handler panicked: %v", deferedErr)
+			if hw.wavefrontAgent.WavefrontConfig.OnPanic != nil {
+				hw.wavefrontAgent.WavefrontConfig.OnPanic(deferedErr)
+			}
 		}
 	}()
 
+	// Used memory before the handler, for MemoryGrowth
+	var memBefore *memStats
+	if hw.wavefrontAgent.WavefrontConfig.MemoryGrowth {
+		memBefore = hw.wavefrontAgent.memoryStats()
+	}
+
+	// CPU time before the handler, for CPUTime
+	var cpuBefore *cpuTimes
+	if hw.wavefrontAgent.WavefrontConfig.CPUTime {
+		cpuBefore, _ = hw.wavefrontAgent.cpuTimes()
+	}
+
 	// Start timer
 	startTime := time.Now()
 
+	// Let the user decorate the context before it is passed to the handler
+	if hw.wavefrontAgent.WavefrontConfig.ContextDecorator != nil {
+		ctx = hw.wavefrontAgent.WavefrontConfig.ContextDecorator(ctx)
+	}
+
+	// Tag the invocation with the workflow step it serves
+	if paths := hw.wavefrontAgent.WavefrontConfig.StepFunctionsTags; len(paths) > 0 {
+		hw.wavefrontAgent.metricsMu.Lock()
+		for k, v := range responseTags(payload, paths, hw.wavefrontAgent.maxResponseTagValues(), hw.wavefrontAgent.stepFunctionsTagValues) {
+			inv.setTag(k, v)
+		}
+		hw.wavefrontAgent.metricsMu.Unlock()
+	}
+
+	// Watch for a handler that still runs when the deadline is near
+	stopWatchdog := func() {}
+	if margin := hw.wavefrontAgent.WavefrontConfig.DeadlineWatchdog; margin > 0 && hasDeadline {
+		stopWatchdog = hw.wavefrontAgent.startDeadlineWatchdog(deadline, margin, invocationPointTags)
+		defer stopWatchdog()
+	}
+
 	// Call handler
-	invocationsCounter.Increment(1)
-	response, err = hw.wrappedHandler(ctx, payload)
-	if err != nil {
-		errCounter.Increment(1)
+	hw.wavefrontAgent.invocationsCounter.Increment(1)
+	response, retries, err := hw.callHandler(ctx, payload)
+	stopWatchdog()
+	if interceptor := hw.wavefrontAgent.WavefrontConfig.ResponseInterceptor; interceptor != nil && err == nil {
+		response = interceptor(response)
+	}
+	if path := hw.wavefrontAgent.WavefrontConfig.ResponseErrorPath; path != "" && err == nil {
+		responseErr, _ = responseError(response, path)
+	}
+
+	duration := time.Since(startTime)
+
+	// Let the SamplingDecider decide before metricsMu is taken, as it may register metrics
+	decider := hw.wavefrontAgent.WavefrontConfig.SamplingDecider
+	var decided bool
+	if decider != nil {
+		decided = decider(ctx, payload, duration, err)
+	}
+
+	// Concurrent invocations assemble and send their metrics one at a time
+	hw.wavefrontAgent.metricsMu.Lock()
+	defer hw.wavefrontAgent.metricsMu.Unlock()
+
+	if paths := hw.wavefrontAgent.WavefrontConfig.ResponseTags; len(paths) > 0 {
+		for k, v := range responseTags(response, paths, hw.wavefrontAgent.maxResponseTagValues(), hw.wavefrontAgent.responseTagValues) {
+			inv.setTag(k, v)
+		}
+	}
+	if hw.wavefrontAgent.WavefrontConfig.HandlerRetries > 0 {
+		hw.wavefrontAgent.setBuiltinCounter("aws.lambda.wf.handler_retries", float64(retries))
 	}
 
 	// Stop timer and report
-	if coldStart {
+	if isColdStart {
 		// Set cold start counter.
-		csCounter.Increment(1)
-		coldStart = false
+		hw.wavefrontAgent.csCounter.Increment(1)
 	}
-	duration := time.Since(startTime)
+	if hw.wavefrontAgent.WavefrontConfig.TimeRemaining {
+		if hasDeadline {
+			hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.time_remaining_ms", deadline.Sub(startTime.Add(duration)).Seconds()*1000)
+			hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.timeout_ms", deadline.Sub(invokeTime).Seconds()*1000)
+		} else {
+			delete(hw.wavefrontAgent.metrics, "aws.lambda.wf.time_remaining_ms")
+			delete(hw.wavefrontAgent.metrics, "aws.lambda.wf.timeout_ms")
+		}
+	}
+	if hw.wavefrontAgent.WavefrontConfig.CPUTime {
+		var cpuAfter *cpuTimes
+		if cpuBefore != nil {
+			cpuAfter, _ = hw.wavefrontAgent.cpuTimes()
+		}
+		if cpuAfter != nil {
+			hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.cpu.user", (cpuAfter.User-cpuBefore.User)*1000)
+			hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.cpu.system", (cpuAfter.System-cpuBefore.System)*1000)
+		} else {
+			delete(hw.wavefrontAgent.metrics, "aws.lambda.wf.cpu.user")
+			delete(hw.wavefrontAgent.metrics, "aws.lambda.wf.cpu.system")
+		}
+	}
+
+	reportTime := hw.wavefrontAgent.timestamp(time.Now())
 
-	reportTime := time.Now().Unix()
+	hw.wavefrontAgent.setBuiltinCounter("aws.lambda.wf.coldstarts", hw.wavefrontAgent.csCounter.take())
+	hw.wavefrontAgent.setBuiltinCounter("aws.lambda.wf.invocations", hw.wavefrontAgent.invocationsCounter.take())
+	reportedDuration := duration
+	if min := hw.wavefrontAgent.WavefrontConfig.MinDuration; reportedDuration < min {
+		reportedDuration = min
+	}
+	hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.duration", reportedDuration.Seconds()*1000)
 
-	hw.wavefrontAgent.counters["aws.lambda.wf.coldstarts"] = csCounter.val
-	hw.wavefrontAgent.counters["aws.lambda.wf.invocations"] = invocationsCounter.val
-	hw.wavefrontAgent.metrics["aws.lambda.wf.duration"] = duration.Seconds() * 1000
+	if dropped := hw.wavefrontAgent.takeDroppedMetrics(); dropped > 0 {
+		hw.wavefrontAgent.setBuiltinCounter("aws.lambda.wf.custom_metrics_dropped", float64(dropped))
+	} else {
+		delete(hw.wavefrontAgent.counters, "aws.lambda.wf.custom_metrics_dropped")
+	}
 
-	memstats := getMemoryStats()
-	hw.wavefrontAgent.metrics["aws.lambda.wf.mem.total"] = memstats.Total
-	hw.wavefrontAgent.metrics["aws.lambda.wf.mem.used"] = memstats.Used
-	hw.wavefrontAgent.metrics["aws.lambda.wf.mem.percentage"] = memstats.UsedPercentage
+	if hw.wavefrontAgent.WavefrontConfig.SLA > 0 {
+		hw.wavefrontAgent.setBuiltinCounter("aws.lambda.wf.sla_violations", 0)
+		if duration > hw.wavefrontAgent.WavefrontConfig.SLA {
+			hw.wavefrontAgent.setBuiltinCounter("aws.lambda.wf.sla_violations", 1)
+		}
+	}
+
+	if hw.wavefrontAgent.WavefrontConfig.BilledDuration {
+		requestID := ""
+		if lc != nil {
+			requestID = lc.AwsRequestID
+		}
+		hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.billed_duration", float64(billedDuration(duration, requestID, hw.wavefrontAgent.WavefrontConfig.BilledDurationSource)/time.Millisecond))
+	}
+
+	if hw.wavefrontAgent.WavefrontConfig.ColdStartGauge {
+		hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.coldstart", 0)
+		if isColdStart {
+			hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.coldstart", 1)
+		}
+	}
+
+	if hw.wavefrontAgent.WavefrontConfig.CountLogLines {
+		hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.log_lines", float64(inv.lines()))
+	}
+
+	memstats := hw.wavefrontAgent.memoryStats()
+	hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.mem.total", memstats.Total)
+	hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.mem.used", memstats.Used)
+	hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.mem.percentage", memoryPercentage(memstats, hw.wavefrontAgent.WavefrontConfig.MemoryPercentBasis))
+	if hw.wavefrontAgent.WavefrontConfig.MemoryHeadroom {
+		if headroom, ok := memoryHeadroom(hw.wavefrontAgent.memPeak.Observe(memstats.Used)); ok {
+			hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.mem.headroom", headroom)
+		}
+	}
+	if memBefore != nil {
+		hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.mem.growth", memstats.Used-memBefore.Used)
+	}
+	for name, value := range hw.wavefrontAgent.runtimeMetrics() {
+		hw.wavefrontAgent.setBuiltinMetric(name, value)
+	}
 
-	// Send all metrics to Wavefront
-	for metricName, metricValue := range hw.wavefrontAgent.metrics {
-		err = hw.wavefrontAgent.sender.SendMetric(metricName, metricValue, reportTime, lambdacontext.FunctionName, hw.wavefrontAgent.WavefrontConfig.PointTags)
+	// Merge the point tags of all sources with the ones the handler set for this invocation
+	pointTags := invocationPointTags()
+
+	if hw.wavefrontAgent.WavefrontConfig.PrintSummary {
+		s := summary{
+			DurationMs:     duration.Seconds() * 1000,
+			ColdStart:      isColdStart,
+			MemTotal:       memstats.Total,
+			MemUsed:        memstats.Used,
+			MemUsedPercent: memstats.UsedPercentage,
+			Tags:           pointTags,
+		}
 		if err != nil {
+			s.Error = err.Error()
+		}
+		if err := printSummary(os.Stdout, s); err != nil {
 			log.Printf("ERROR :: %s", err.Error())
 		}
 	}
 
-	// Send all counters to Wavefront
-	for metricName, metricValue := range hw.wavefrontAgent.counters {
-		err = hw.wavefrontAgent.sender.SendDeltaCounter(metricName, metricValue, lambdacontext.FunctionName, hw.wavefrontAgent.WavefrontConfig.PointTags)
-		if err != nil {
+	if hw.wavefrontAgent.WavefrontConfig.ConfiguredTimeout {
+		if hasDeadline {
+			hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.configured_timeout", deadline.Sub(invokeTime).Seconds()*1000)
+		} else {
+			delete(hw.wavefrontAgent.metrics, "aws.lambda.wf.configured_timeout")
+		}
+	}
+
+	if hw.wavefrontAgent.WavefrontConfig.FlushDuration {
+		if flushDuration, ok := hw.wavefrontAgent.takeFlushDuration(); ok {
+			hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.flush_duration", flushDuration.Seconds()*1000)
+		} else {
+			delete(hw.wavefrontAgent.metrics, "aws.lambda.wf.flush_duration")
+		}
+	}
+
+	if hw.wavefrontAgent.WavefrontConfig.Overhead {
+		hw.wavefrontAgent.setBuiltinMetric("aws.lambda.wf.overhead", (time.Since(invokeTime)-duration).Seconds()*1000)
+	}
+
+	// Write the OpenMetrics output after all built-in metrics are set
+	if hw.wavefrontAgent.WavefrontConfig.OpenMetrics {
+		if err := writeOpenMetrics(os.Stdout, hw.wavefrontAgent.metrics, hw.wavefrontAgent.counters, pointTags); err != nil {
 			log.Printf("ERROR :: %s", err.Error())
 		}
 	}
 
+	// Send all metrics and counters to Wavefront. Metrics are skipped when this invocation isn't sampled.
+	sampleRate := defaultSampleRate
+	if hw.wavefrontAgent.WavefrontConfig.SampleRate != nil {
+		sampleRate = *hw.wavefrontAgent.WavefrontConfig.SampleRate
+	}
+	sampled := inv.sampled(sampleRate, rand.Float64())
+	if decider != nil {
+		sampled = inv.forced() || decided
+	}
+	if hw.wavefrontAgent.WavefrontConfig.FlushOnErrorOnly && err == nil && responseErr == "" && !isColdStart {
+		// The metrics of routine invocations are dropped, and their counters wait in the sender until
+		// the next flush
+		sampled = inv.forced()
+		skipFlush = !hw.wavefrontAgent.flushDue(time.Now())
+	}
+
+	sendStart = time.Now()
+	hw.wavefrontAgent.startRetryBudget()
+	if hw.wavefrontAgent.WavefrontConfig.CountersFirst {
+		hw.wavefrontAgent.sendCounters(lambdacontext.FunctionName, pointTags)
+	}
+	if sampled {
+		hw.wavefrontAgent.sendMetrics(reportTime, lambdacontext.FunctionName, pointTags)
+	}
+	if !hw.wavefrontAgent.WavefrontConfig.CountersFirst {
+		hw.wavefrontAgent.sendCounters(lambdacontext.FunctionName, pointTags)
+	}
+	hw.wavefrontAgent.sendCustom(reportTime, lambdacontext.FunctionName, pointTags)
+	hw.wavefrontAgent.sendCanary(time.Now(), lambdacontext.FunctionName, pointTags)
+	if isColdStart {
+		hw.wavefrontAgent.sendColdStartDuration(invokeTime, reportTime, lambdacontext.FunctionName, pointTags)
+	}
+	hw.wavefrontAgent.sendContainerStarted(reportTime, lambdacontext.FunctionName, pointTags)
+	hw.wavefrontAgent.sendContainerRegistered(reportTime, lambdacontext.FunctionName, pointTags)
+	if buckets := hw.wavefrontAgent.WavefrontConfig.EventHashBuckets; buckets > 0 {
+		if bucket, ok := eventHashBucket(payload, hw.wavefrontAgent.WavefrontConfig.EventHashField, buckets); ok {
+			tags := invocationPointTags()
+			tags["EventHashBucket"] = strconv.Itoa(bucket)
+			hw.wavefrontAgent.send(DeltaCounter{Name: "aws.lambda.wf.event_hash", Value: 1}, reportTime, lambdacontext.FunctionName, tags)
+		}
+	}
+
 	return response, err
 }
 
+// callHandler calls the wrapped handler and, when it returns an error or panics, calls it again up
+// to HandlerRetries times, waiting twice as long between every attempt. It returns the outcome of
+// the last attempt and the number of retries that were needed. A panic during the last attempt is
+// not recovered.
+func (hw *HandlerWrapper) callHandler(ctx context.Context, payload interface{}) (interface{}, int, error) {
+	backoff := hw.wavefrontAgent.WavefrontConfig.HandlerRetryBackoff
+	if backoff <= 0 {
+		backoff = defaultHandlerRetryBackoff
+	}
+
+	for retries := 0; ; retries++ {
+		if retries >= hw.wavefrontAgent.WavefrontConfig.HandlerRetries {
+			response, err := hw.wrappedHandler(ctx, payload)
+			return response, retries, err
+		}
+
+		response, err := hw.tryHandler(ctx, payload)
+		if err == nil {
+			return response, retries, nil
+		}
+		if _, ok := err.(*deserializationError); ok {
+			// The event won't unmarshal any better the next time
+			return response, retries, err
+		}
+		log.Printf("ERROR :: attempt %d of handler failed: %s", retries+1, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return response, retries, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// tryHandler calls the wrapped handler and turns a panic into an error.
+func (hw *HandlerWrapper) tryHandler(ctx context.Context, payload interface{}) (response interface{}, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("handler panicked: %v", e)
+		}
+	}()
+	return hw.wrappedHandler(ctx, payload)
+}
+
+// billedDuration returns the billed duration for the invocation with the given request ID from source, when it
+// is available there. Otherwise it approximates the billed duration by rounding duration up to the next millisecond.
+func billedDuration(duration time.Duration, requestID string, source func(string) (time.Duration, bool)) time.Duration {
+	if source != nil {
+		if billed, ok := source(requestID); ok {
+			return billed
+		}
+	}
+	billed := duration.Truncate(time.Millisecond)
+	if billed < duration {
+		billed += time.Millisecond
+	}
+	return billed
+}
+
+// errorPointTags adds the phase point tag to the point tags of an error, which is init for errors
+// during the cold start invocation and invoke for all other errors.
+func errorPointTags(tags map[string]string, isColdStart bool) map[string]string {
+	if isColdStart {
+		tags["phase"] = "init"
+	} else {
+		tags["phase"] = "invoke"
+	}
+	return tags
+}
+
+// errorPatternTag adds the ErrorPattern point tag for the error message to the point tags of an error,
+// when ErrorPatterns are configured.
+func (hw *HandlerWrapper) errorPatternTag(tags map[string]string, message string) map[string]string {
+	if patterns := hw.wavefrontAgent.WavefrontConfig.ErrorPatterns; len(patterns) > 0 {
+		tags["ErrorPattern"] = matchErrorPattern(patterns, message)
+	}
+	return tags
+}
+
+// ParseARNTags derives the point tags that come from the ARN of the invoked function. It is the
+// default ARNParser. Expected formats for Lambda ARN are:
+// https://docs.aws.amazon.com/general/latest/gr/aws-arns-and-namespaces.html#arn-syntax-lambda
+func ParseARNTags(invokedFunctionArn string) map[string]string {
+	tags := make(map[string]string)
+	if invokedFunctionArn == "" {
+		return tags
+	}
+	splitArn := strings.Split(invokedFunctionArn, ":")
+
+	// Segments that are missing from the ARN are skipped, and their point tags omitted.
+	tags["LambdaArn"] = invokedFunctionArn
+	if len(splitArn) > 1 {
+		tags["Partition"] = splitArn[1]
+	}
+	if len(splitArn) > 3 {
+		tags["Region"] = splitArn[3]
+	}
+	if len(splitArn) > 4 {
+		tags["accountId"] = splitArn[4]
+	}
+	if len(splitArn) < 7 {
+		return tags
+	}
+
+	if splitArn[5] == "function" {
+		tags["Resource"] = splitArn[6]
+		if len(splitArn) == 8 {
+			tags["Resource"] += ":" + splitArn[7]
+		}
+	} else if splitArn[5] == "event-source-mappings" {
+		tags["EventSourceMappings"] = splitArn[6]
+	}
+
+	return tags
+}
+
+// parseStage returns the alias from the qualifier of the invoked function ARN. When the function is
+// invoked without a qualifier, or with a version (including $LATEST), the value of the environment
+// variable WAVEFRONT_STAGE is returned, which is empty when it isn't set.
+func parseStage(invokedFunctionArn string) string {
+	splitArn := strings.Split(invokedFunctionArn, ":")
+	if len(splitArn) == 8 && splitArn[5] == "function" {
+		qualifier := splitArn[7]
+		if _, err := strconv.Atoi(qualifier); err != nil && qualifier != "$LATEST" {
+			return qualifier
+		}
+	}
+	return os.Getenv("WAVEFRONT_STAGE")
+}
+
+// deserializationError is returned by the handler when the event can't be unmarshaled into the type
+// of the event argument of the handler.
+type deserializationError struct {
+	err error
+}
+
+func (e *deserializationError) Error() string {
+	return e.err.Error()
+}
+
+// configPointTags returns the point tags of the configuration, which are the StaticPointTags merged
+// with the PointTags, where PointTags win on a key collision.
+func (wa *WavefrontAgent) configPointTags() map[string]string {
+	if len(wa.WavefrontConfig.StaticPointTags) == 0 {
+		return wa.WavefrontConfig.PointTags
+	}
+	tags := make(map[string]string, len(wa.WavefrontConfig.StaticPointTags)+len(wa.WavefrontConfig.PointTags))
+	for k, v := range wa.WavefrontConfig.StaticPointTags {
+		tags[k] = v
+	}
+	for k, v := range wa.WavefrontConfig.PointTags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// functionRegion returns the region from the invoked function ARN, or the value of the environment
+// variable AWS_REGION when the ARN doesn't have one.
+func functionRegion(invokedFunctionArn string) string {
+	if splitArn := strings.Split(invokedFunctionArn, ":"); len(splitArn) > 3 && splitArn[3] != "" {
+		return splitArn[3]
+	}
+	return os.Getenv("AWS_REGION")
+}
+
+// regionAllowed reports whether region is in allowList. All regions are allowed when allowList is empty.
+func regionAllowed(allowList []string, region string) bool {
+	if len(allowList) == 0 {
+		return true
+	}
+	for _, allowed := range allowList {
+		if allowed == region {
+			return true
+		}
+	}
+	return false
+}
+
 // errorHandler returns an error wrapped in a lambdaHandler function.
 func errorHandler(e error) lambdaHandler {
 	return func(ctx context.Context, event interface{}) (interface{}, error) {
@@ -148,7 +618,10 @@ func errorHandler(e error) lambdaHandler {
 // true or false depending on whether the lambdaHandler has a context argument. If the arguments are not valid, an error
 // is returned. Detailed information on the valid handler signatures can be found in the AWS Lambda documentation
 // https://docs.aws.amazon.com/lambda/latest/dg/go-programming-model-handler-types.html
-func validateArguments(handler reflect.Type) (bool, error) {
+//
+// In strict mode only a first argument of exactly type context.Context counts as a Context. A first argument of
+// any other type that implements context.Context is ambiguous and results in an error.
+func validateArguments(handler reflect.Type, strict bool) (bool, error) {
 	handlerTakesContext := false
 	if handler.NumIn() > 2 {
 		return false, fmt.Errorf("handlers may not take more than two arguments, but handler takes %d", handler.NumIn())
@@ -156,6 +629,9 @@ func validateArguments(handler reflect.Type) (bool, error) {
 		contextType := reflect.TypeOf((*context.Context)(nil)).Elem()
 		argumentType := handler.In(0)
 		handlerTakesContext = argumentType.Implements(contextType)
+		if strict && handlerTakesContext && argumentType != contextType {
+			return false, fmt.Errorf("handler takes %s as first argument, which implements Context but is not Context", argumentType)
+		}
 		if handler.NumIn() > 1 && !handlerTakesContext {
 			return false, fmt.Errorf("handler takes two arguments, but the first is not Context. got %s", argumentType.Kind())
 		}
@@ -177,6 +653,9 @@ func validateReturns(handler reflect.Type) error {
 		if !handler.Out(1).Implements(errorType) {
 			return fmt.Errorf("handler returns two values, but the second does not implement error")
 		}
+		if err := validateSerializable(handler.Out(0), make(map[reflect.Type]bool)); err != nil {
+			return err
+		}
 	} else if handler.NumOut() == 1 {
 		if !handler.Out(0).Implements(errorType) {
 			return fmt.Errorf("handler returns a single value, but it does not implement error")
@@ -185,26 +664,69 @@ func validateReturns(handler reflect.Type) error {
 	return nil
 }
 
-// newHandler Creates the base lambda handler, which will do basic payload unmarshaling before defering to handlerSymbol.
-// If handlerSymbol is not a valid handler, the returned function will be a handler that just reports the validation error.
-func newHandler(handlerSymbol interface{}) lambdaHandler {
+// validateSerializable validates whether values of type t can be serialized to JSON, which is needed for responses of
+// the lambdaHandler. Channels, functions, complex numbers and unsafe pointers can't be serialized, neither directly nor
+// as the element of a pointer, slice, array or map. Struct fields aren't inspected, as those commonly contain values the
+// JSON encoder skips.
+func validateSerializable(t reflect.Type, seen map[reflect.Type]bool) error {
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return fmt.Errorf("handler returns a value of type %s, which can't be serialized to JSON", t)
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return validateSerializable(t.Elem(), seen)
+	}
+	return nil
+}
+
+// isNil reports whether v is the nil value of a type that can be nil.
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		return v.IsNil()
+	}
+	return false
+}
+
+// validateHandler validates whether handlerSymbol is a function with valid arguments and returns, and
+// reports whether it takes a Context. When strict is true, the arguments are validated in strict mode.
+func validateHandler(handlerSymbol interface{}, strict bool) (bool, error) {
 	if handlerSymbol == nil {
-		return errorHandler(fmt.Errorf("handler is nil"))
+		return false, fmt.Errorf("handler is nil")
 	}
-	handler := reflect.ValueOf(handlerSymbol)
 	handlerType := reflect.TypeOf(handlerSymbol)
 	if handlerType.Kind() != reflect.Func {
-		return errorHandler(fmt.Errorf("handler kind %s is not %s", handlerType.Kind(), reflect.Func))
+		return false, fmt.Errorf("handler kind %s is not %s", handlerType.Kind(), reflect.Func)
 	}
 
-	takesContext, err := validateArguments(handlerType)
+	takesContext, err := validateArguments(handlerType, strict)
 	if err != nil {
-		return errorHandler(err)
+		return false, err
 	}
 
 	if err := validateReturns(handlerType); err != nil {
+		return false, err
+	}
+	return takesContext, nil
+}
+
+// newHandler Creates the base lambda handler, which will do basic payload unmarshaling before defering to handlerSymbol.
+// If handlerSymbol is not a valid handler, the returned function will be a handler that just reports the validation error.
+// When strict is true, the arguments of the handler are validated in strict mode.
+func newHandler(handlerSymbol interface{}, strict bool) lambdaHandler {
+	takesContext, err := validateHandler(handlerSymbol, strict)
+	if err != nil {
 		return errorHandler(err)
 	}
+	handler := reflect.ValueOf(handlerSymbol)
+	handlerType := reflect.TypeOf(handlerSymbol)
+
+	// Handlers without an event, like func() error or func(context.Context), never decode the payload
+	takesEvent := handlerType.NumIn() == 2 || (handlerType.NumIn() == 1 && !takesContext)
 
 	return func(ctx context.Context, payload interface{}) (interface{}, error) {
 		// construct arguments
@@ -213,17 +735,17 @@ func newHandler(handlerSymbol interface{}) lambdaHandler {
 			args = append(args, reflect.ValueOf(ctx))
 		}
 
-		if (handlerType.NumIn() == 1 && !takesContext) || handlerType.NumIn() == 2 {
-			payloadBytes, err := json.Marshal(payload)
+		if takesEvent {
+			eventType := handlerType.In(handlerType.NumIn() - 1)
+			event := reflect.New(eventType)
+
+			payloadBytes, err := payloadJSON(payload, eventType)
 			if err != nil {
 				return nil, err
 			}
 
-			eventType := handlerType.In(handlerType.NumIn() - 1)
-			event := reflect.New(eventType)
-
 			if err := json.Unmarshal(payloadBytes, event.Interface()); err != nil {
-				return nil, err
+				return nil, &deserializationError{err: err}
 			}
 
 			args = append(args, event.Elem())
@@ -231,11 +753,14 @@ func newHandler(handlerSymbol interface{}) lambdaHandler {
 
 		response := handler.Call(args)
 
-		// convert return values into (interface{}, error)
+		// convert return values into (interface{}, error). The error may be returned as a custom error interface
+		// or pointer type, in which case a nil value of that type must not count as an error.
 		var err error
 		if len(response) > 0 {
-			if errVal, ok := response[len(response)-1].Interface().(error); ok {
-				err = errVal
+			if errVal := response[len(response)-1]; !isNil(errVal) {
+				if e, ok := errVal.Interface().(error); ok {
+					err = e
+				}
 			}
 		}
 		var val interface{}
@@ -246,3 +771,20 @@ func newHandler(handlerSymbol interface{}) lambdaHandler {
 		return val, err
 	}
 }
+
+// payloadJSON returns the JSON encoding of payload, which is decoded into the event of the handler.
+// A payload that already is JSON, as a json.RawMessage or a []byte, is returned as is, unless the
+// event is a []byte itself, which is encoded as a base64 string.
+func payloadJSON(payload interface{}, eventType reflect.Type) ([]byte, error) {
+	switch p := payload.(type) {
+	case json.RawMessage:
+		if len(p) > 0 {
+			return p, nil
+		}
+	case []byte:
+		if len(p) > 0 && eventType != reflect.TypeOf(p) {
+			return p, nil
+		}
+	}
+	return json.Marshal(payload)
+}
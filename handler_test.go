@@ -2,11 +2,47 @@ package wflambda
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/stretchr/testify/assert"
 )
 
+// newTestContext returns a context that looks like the one the Lambda runtime passes to a handler.
+func newTestContext() context.Context {
+	return lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{
+		AwsRequestID:       "c6af9ac6-7b61-11e6-9a41-93e812345678",
+		InvokedFunctionArn: "arn:aws:lambda:us-west-2:123456789012:function:my-function",
+	})
+}
+
+// newTestAgent returns an enabled agent that records its data.
+func newTestAgent(w *WavefrontConfig) (*WavefrontAgent, *Recorder) {
+	enabled := true
+	w.Enabled = &enabled
+	return NewRecordingAgent(w)
+}
+
+// setColdStart sets whether the next invocation is a cold start, and restores the cold start state of
+// the container when the test ends.
+func setColdStart(t *testing.T, cold bool) {
+	var value int32
+	if cold {
+		value = 1
+	}
+	old := atomic.SwapInt32(&coldStart, value)
+	t.Cleanup(func() { atomic.StoreInt32(&coldStart, old) })
+}
+
 func TestHandler(t *testing.T) {
 	assert := assert.New(t)
 
@@ -14,8 +50,1188 @@ func TestHandler(t *testing.T) {
 	assert.NotNil(wa)
 
 	handler := func(ctx context.Context, payload interface{}) (interface{}, error) { return nil, nil }
-	wrapper := newHandler(handler)
+	wrapper := newHandler(handler, false)
 	hw := NewHandlerWrapper(handler, wa)
 
 	assert.IsType(hw.wrappedHandler, wrapper)
 }
+
+func TestParseARNTags(t *testing.T) {
+	assert := assert.New(t)
+
+	tags := ParseARNTags("arn:aws:lambda:us-west-2:123456789012:function:my-function")
+	assert.Equal("aws", tags["Partition"])
+	assert.Equal("us-west-2", tags["Region"])
+	assert.Equal("123456789012", tags["accountId"])
+	assert.Equal("my-function", tags["Resource"])
+
+	tags = ParseARNTags("arn:aws-us-gov:lambda:us-gov-west-1:123456789012:function:my-function:prod")
+	assert.Equal("aws-us-gov", tags["Partition"])
+	assert.Equal("us-gov-west-1", tags["Region"])
+	assert.Equal("my-function:prod", tags["Resource"])
+
+	tags = ParseARNTags("arn:aws-cn:lambda:cn-north-1:123456789012:event-source-mappings:fa123456-14a1-4fd2-9fec-83de64ad683de6d47")
+	assert.Equal("aws-cn", tags["Partition"])
+	assert.Equal("cn-north-1", tags["Region"])
+	assert.Equal("fa123456-14a1-4fd2-9fec-83de64ad683de6d47", tags["EventSourceMappings"])
+}
+
+func TestParseARNTagsSegments(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Empty(ParseARNTags(""))
+
+	tags := ParseARNTags("arn:aws:lambda:us-west-2:123456789012")
+	assert.Equal(map[string]string{
+		"LambdaArn": "arn:aws:lambda:us-west-2:123456789012",
+		"Partition": "aws",
+		"Region":    "us-west-2",
+		"accountId": "123456789012",
+	}, tags)
+
+	tags = ParseARNTags("arn:aws:lambda:us-west-2:123456789012:function")
+	assert.Equal("123456789012", tags["accountId"])
+	assert.NotContains(tags, "Resource")
+
+	tags = ParseARNTags("arn:aws:lambda:us-west-2:123456789012:function:my-function")
+	assert.Equal("my-function", tags["Resource"])
+
+	tags = ParseARNTags("arn:aws:lambda:us-west-2:123456789012:function:my-function:prod")
+	assert.Equal("my-function:prod", tags["Resource"])
+
+	tags = ParseARNTags("not-an-arn")
+	assert.Equal(map[string]string{"LambdaArn": "not-an-arn"}, tags)
+
+	wa, r := newTestAgent(&WavefrontConfig{})
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{InvokedFunctionArn: "arn:aws:lambda"})
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(ctx, nil)
+	assert.NoError(err)
+	assert.Equal("aws", r.GetTags()["Partition"])
+	assert.NotContains(r.GetTags(), "Region")
+}
+
+func TestInvokeSampling(t *testing.T) {
+	assert := assert.New(t)
+
+	rate := 0.0
+	wa, fs := newTestAgent(&WavefrontConfig{SampleRate: &rate})
+	handler := func(ctx context.Context) error { return nil }
+	_, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Empty(fs.metrics)
+	assert.Contains(fs.counters, "aws.lambda.wf.invocations")
+
+	wa, fs = newTestAgent(&WavefrontConfig{SampleRate: &rate})
+	handler = func(ctx context.Context) error {
+		ForceSample(ctx)
+		return nil
+	}
+	_, err = NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Contains(fs.metrics, "aws.lambda.wf.duration")
+}
+
+func TestInvokeSamplingDecider(t *testing.T) {
+	assert := assert.New(t)
+
+	var gotPayload interface{}
+	var gotErr error
+	decider := func(ctx context.Context, payload interface{}, duration time.Duration, err error) bool {
+		gotPayload = payload
+		gotErr = err
+		return err != nil
+	}
+	rate := 1.0
+	wa, fs := newTestAgent(&WavefrontConfig{SampleRate: &rate, SamplingDecider: decider})
+	_, err := NewHandlerWrapper(func() error { return nil }, wa).Invoke(newTestContext(), "fast")
+	assert.NoError(err)
+	assert.Equal("fast", gotPayload)
+	assert.Empty(fs.metrics)
+	assert.Contains(fs.counters, "aws.lambda.wf.invocations")
+
+	wa, fs = newTestAgent(&WavefrontConfig{SamplingDecider: decider})
+	_, err = NewHandlerWrapper(func() error { return errors.New("failed") }, wa).Invoke(newTestContext(), nil)
+	assert.Error(err)
+	assert.EqualError(gotErr, "failed")
+	assert.Contains(fs.metrics, "aws.lambda.wf.duration")
+
+	wa, fs = newTestAgent(&WavefrontConfig{SamplingDecider: decider})
+	handler := func(ctx context.Context) error {
+		ForceSample(ctx)
+		return nil
+	}
+	_, err = NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Contains(fs.metrics, "aws.lambda.wf.duration")
+
+	// The decider can register metrics
+	wa, fs = newTestAgent(&WavefrontConfig{})
+	wa.WavefrontConfig.SamplingDecider = func(ctx context.Context, payload interface{}, duration time.Duration, err error) bool {
+		wa.RegisterMetric("decided", 1)
+		return true
+	}
+	done := make(chan struct{})
+	go func() {
+		NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the invocation deadlocked in the SamplingDecider")
+	}
+	assert.Contains(fs.metrics, "decided")
+}
+
+func TestInvokeOperation(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, fs := newTestAgent(&WavefrontConfig{})
+	handler := func(ctx context.Context) error {
+		SetOperation(ctx, "process_payment")
+		return nil
+	}
+	_, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal("process_payment", fs.tags["Operation"])
+	assert.NotContains(wa.WavefrontConfig.PointTags, "Operation")
+}
+
+func TestInvokeContextDecorator(t *testing.T) {
+	assert := assert.New(t)
+
+	type key struct{}
+	wa, _ := newTestAgent(&WavefrontConfig{
+		ContextDecorator: func(ctx context.Context) context.Context {
+			return context.WithValue(ctx, key{}, "dependency")
+		},
+	})
+	handler := func(ctx context.Context) (string, error) {
+		assert.NotNil(invocationFromContext(ctx))
+		return ctx.Value(key{}).(string), nil
+	}
+	response, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal("dependency", response)
+}
+
+func TestInvokeErrorPhase(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := func() error { return errors.New("init failed") }
+
+	setColdStart(t, true)
+	wa, fs := newTestAgent(&WavefrontConfig{})
+	_, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.Error(err)
+	assert.Contains(fs.counters, "aws.lambda.wf.errors")
+	assert.Equal("init", fs.tags["phase"])
+
+	wa, fs = newTestAgent(&WavefrontConfig{})
+	_, err = NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.Error(err)
+	assert.Equal("invoke", fs.tags["phase"])
+
+	wa, fs = newTestAgent(&WavefrontConfig{})
+	assert.Panics(func() {
+		NewHandlerWrapper(func() { panic("boom") }, wa).Invoke(newTestContext(), nil)
+	})
+	assert.Equal("invoke", fs.tags["phase"])
+}
+
+func TestInvokeOnPanic(t *testing.T) {
+	assert := assert.New(t)
+
+	var recovered interface{}
+	wa, fs := newTestAgent(&WavefrontConfig{
+		OnPanic: func(e interface{}) { recovered = e },
+	})
+	assert.NotPanics(func() {
+		_, err := NewHandlerWrapper(func() { panic("boom") }, wa).Invoke(newTestContext(), nil)
+		assert.EqualError(err, "handler panicked: boom")
+	})
+	assert.Equal("boom", recovered)
+	assert.Contains(fs.counters, "aws.lambda.wf.panics")
+	assert.NotContains(fs.counters, "aws.lambda.wf.errors")
+}
+
+func TestInvokeRecoverPanics(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{RecoverPanics: true})
+	assert.NotPanics(func() {
+		_, err := NewHandlerWrapper(func() { panic("boom") }, wa).Invoke(newTestContext(), nil)
+		assert.EqualError(err, "handler panicked: boom")
+	})
+	panics, _ := r.GetCounter("aws.lambda.wf.panics")
+	assert.Equal(float64(1), panics)
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	assert.PanicsWithValue("boom", func() {
+		NewHandlerWrapper(func() { panic("boom") }, wa).Invoke(newTestContext(), nil)
+	})
+	panics, _ = r.GetCounter("aws.lambda.wf.panics")
+	assert.Equal(float64(1), panics)
+}
+
+func TestInvokeErrorsAndPanics(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		name    string
+		handler func() error
+		errors  float64
+		panics  float64
+	}{
+		{"success", func() error { return nil }, 0, 0},
+		{"error", func() error { return errors.New("failed") }, 1, 0},
+		{"panic", func() error { panic("boom") }, 0, 1},
+	} {
+		wa, r := newTestAgent(&WavefrontConfig{OnPanic: func(interface{}) {}})
+		hw := NewHandlerWrapper(tc.handler, wa)
+		_, _ = hw.Invoke(newTestContext(), nil)
+		errors, _ := r.GetCounter("aws.lambda.wf.errors")
+		assert.Equal(tc.errors, errors, tc.name)
+		panics, _ := r.GetCounter("aws.lambda.wf.panics")
+		assert.Equal(tc.panics, panics, tc.name)
+
+		// A second invocation counts its own error once, and not the one of the first again
+		_, _ = hw.Invoke(newTestContext(), nil)
+		errors, _ = r.GetCounter("aws.lambda.wf.errors")
+		assert.Equal(2*tc.errors, errors, tc.name)
+		panics, _ = r.GetCounter("aws.lambda.wf.panics")
+		assert.Equal(2*tc.panics, panics, tc.name)
+	}
+}
+
+func TestInvokeARNParser(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{
+		ARNParser: func(arn string) map[string]string {
+			tags := ParseARNTags(arn)
+			tags["Region"] = "custom-" + tags["Region"]
+			delete(tags, "LambdaArn")
+			return tags
+		},
+	})
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal("custom-us-west-2", r.GetTags()["Region"])
+	assert.NotContains(r.GetTags(), "LambdaArn")
+	assert.Equal("123456789012", r.GetTags()["accountId"])
+}
+
+func TestParseStage(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("prod", parseStage("arn:aws:lambda:us-west-2:123456789012:function:my-function:prod"))
+	assert.Equal("", parseStage("arn:aws:lambda:us-west-2:123456789012:function:my-function:42"))
+	assert.Equal("", parseStage("arn:aws:lambda:us-west-2:123456789012:function:my-function:$LATEST"))
+	assert.Equal("", parseStage("arn:aws:lambda:us-west-2:123456789012:function:my-function"))
+
+	os.Setenv("WAVEFRONT_STAGE", "staging")
+	defer os.Unsetenv("WAVEFRONT_STAGE")
+	assert.Equal("prod", parseStage("arn:aws:lambda:us-west-2:123456789012:function:my-function:prod"))
+	assert.Equal("staging", parseStage("arn:aws:lambda:us-west-2:123456789012:function:my-function:42"))
+}
+
+func TestInvokeCountersFirst(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := func() error { return nil }
+
+	wa, fs := newTestAgent(&WavefrontConfig{})
+	_, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Contains(fs.metrics, fs.sent[0])
+
+	wa, fs = newTestAgent(&WavefrontConfig{CountersFirst: true})
+	_, err = NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	for i, name := range fs.sent {
+		if i < len(fs.counters) {
+			assert.Contains(fs.counters, name)
+		} else {
+			assert.Contains(fs.metrics, name)
+		}
+	}
+}
+
+func TestInvokeColdStartGauge(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := func() error { return nil }
+	wa, fs := newTestAgent(&WavefrontConfig{ColdStartGauge: true})
+
+	setColdStart(t, true)
+	_, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal(float64(1), fs.metrics["aws.lambda.wf.coldstart"])
+
+	_, err = NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal(float64(0), fs.metrics["aws.lambda.wf.coldstart"])
+
+	wa, fs = newTestAgent(&WavefrontConfig{})
+	_, err = NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.NotContains(fs.metrics, "aws.lambda.wf.coldstart")
+}
+
+func TestInvokeSLA(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{SLA: time.Millisecond})
+	hw := NewHandlerWrapper(func() { time.Sleep(5 * time.Millisecond) }, wa)
+	_, err := hw.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	violations, _ := r.GetCounter("aws.lambda.wf.sla_violations")
+	assert.Equal(float64(1), violations)
+
+	wa, r = newTestAgent(&WavefrontConfig{SLA: time.Minute})
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	violations, ok := r.GetCounter("aws.lambda.wf.sla_violations")
+	assert.True(ok)
+	assert.Equal(float64(0), violations)
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetCounter("aws.lambda.wf.sla_violations")
+	assert.False(ok)
+}
+
+func TestInvokeFallbackTags(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{
+		PointTags:    map[string]string{"env": "test"},
+		FallbackTags: map[string]string{"env": "local", "Resource": "my-function"},
+	})
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(context.Background(), nil)
+	assert.NoError(err)
+	tags := r.GetTags()
+	assert.Equal("test", tags["env"])
+	assert.Equal("my-function", tags["Resource"])
+	assert.NotContains(tags, "Region")
+
+	wa, r = newTestAgent(&WavefrontConfig{
+		FallbackTags: map[string]string{"Resource": "local"},
+	})
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal("my-function", r.GetTags()["Resource"])
+}
+
+func TestInvokeDeserializationError(t *testing.T) {
+	assert := assert.New(t)
+
+	type order struct {
+		Quantity int `json:"quantity"`
+	}
+	attempts := 0
+	handler := func(o order) error {
+		attempts++
+		return nil
+	}
+	wa, r := newTestAgent(&WavefrontConfig{HandlerRetries: 2, HandlerRetryBackoff: time.Millisecond})
+	_, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), map[string]interface{}{"quantity": "three"})
+	assert.Error(err)
+	assert.Equal(0, attempts)
+	value, ok := r.GetCounter("aws.lambda.wf.deserialization_errors")
+	assert.True(ok)
+	assert.Equal(float64(1), value)
+	_, ok = r.GetCounter("aws.lambda.wf.errors")
+	assert.True(ok)
+	assert.Equal("deserialization", r.GetTags()["errorType"])
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	_, err = NewHandlerWrapper(func() error { return errors.New("out of stock") }, wa).Invoke(newTestContext(), nil)
+	assert.Error(err)
+	_, ok = r.GetCounter("aws.lambda.wf.deserialization_errors")
+	assert.False(ok)
+	assert.NotContains(r.GetTags(), "errorType")
+}
+
+func TestInvokeHandlerRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	attempts := 0
+	handler := func() (string, error) {
+		attempts++
+		if attempts == 1 {
+			panic("flaky connection")
+		}
+		if attempts == 2 {
+			return "", errors.New("still flaky")
+		}
+		return "done", nil
+	}
+	wa, r := newTestAgent(&WavefrontConfig{HandlerRetries: 3, HandlerRetryBackoff: time.Millisecond})
+	response, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal("done", response)
+	assert.Equal(3, attempts)
+	retries, _ := r.GetCounter("aws.lambda.wf.handler_retries")
+	assert.Equal(float64(2), retries)
+
+	attempts = 0
+	failing := func() error {
+		attempts++
+		return errors.New("broken")
+	}
+	wa, _ = newTestAgent(&WavefrontConfig{HandlerRetries: 2, HandlerRetryBackoff: time.Millisecond})
+	_, err = NewHandlerWrapper(failing, wa).Invoke(newTestContext(), nil)
+	assert.EqualError(err, "broken")
+	assert.Equal(3, attempts)
+
+	attempts = 0
+	wa, r = newTestAgent(&WavefrontConfig{})
+	_, err = NewHandlerWrapper(failing, wa).Invoke(newTestContext(), nil)
+	assert.Error(err)
+	assert.Equal(1, attempts)
+	_, ok := r.GetCounter("aws.lambda.wf.handler_retries")
+	assert.False(ok)
+}
+
+// eventContext is an event type that happens to implement context.Context.
+type eventContext interface {
+	context.Context
+	Name() string
+}
+
+func TestValidateArgumentsStrict(t *testing.T) {
+	assert := assert.New(t)
+
+	takesContext, err := validateArguments(reflect.TypeOf(func(context.Context, string) error { return nil }), true)
+	assert.NoError(err)
+	assert.True(takesContext)
+
+	takesContext, err = validateArguments(reflect.TypeOf(func(string) error { return nil }), true)
+	assert.NoError(err)
+	assert.False(takesContext)
+
+	takesContext, err = validateArguments(reflect.TypeOf(func(eventContext) error { return nil }), false)
+	assert.NoError(err)
+	assert.True(takesContext)
+
+	_, err = validateArguments(reflect.TypeOf(func(eventContext) error { return nil }), true)
+	assert.Error(err)
+	assert.Contains(err.Error(), "implements Context but is not Context")
+}
+
+func TestValidateReturnsSerializable(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateReturns(reflect.TypeOf(func() (string, error) { return "", nil })))
+	assert.NoError(validateReturns(reflect.TypeOf(func() (map[string][]int, error) { return nil, nil })))
+	assert.NoError(validateReturns(reflect.TypeOf(func() (interface{}, error) { return nil, nil })))
+
+	assert.Error(validateReturns(reflect.TypeOf(func() chan int { return nil })))
+	assert.Error(validateReturns(reflect.TypeOf(func() (chan int, error) { return nil, nil })))
+	assert.Error(validateReturns(reflect.TypeOf(func() (func(), error) { return nil, nil })))
+	assert.Error(validateReturns(reflect.TypeOf(func() ([]chan int, error) { return nil, nil })))
+	assert.Error(validateReturns(reflect.TypeOf(func() (map[string]func(), error) { return nil, nil })))
+
+	type list []list
+	assert.NoError(validateReturns(reflect.TypeOf(func() (list, error) { return nil, nil })))
+
+	handler := newHandler(func() (chan int, error) { return nil, nil }, false)
+	_, err := handler(context.Background(), nil)
+	assert.EqualError(err, "handler returns a value of type chan int, which can't be serialized to JSON")
+}
+
+func TestBilledDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(13*time.Millisecond, billedDuration(12100*time.Microsecond, "id", nil))
+	assert.Equal(12*time.Millisecond, billedDuration(12*time.Millisecond, "id", nil))
+
+	source := func(requestID string) (time.Duration, bool) {
+		if requestID == "known" {
+			return 100 * time.Millisecond, true
+		}
+		return 0, false
+	}
+	assert.Equal(100*time.Millisecond, billedDuration(12100*time.Microsecond, "known", source))
+	assert.Equal(13*time.Millisecond, billedDuration(12100*time.Microsecond, "unknown", source))
+
+	wa, r := newTestAgent(&WavefrontConfig{BilledDuration: true})
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok := r.GetMetric("aws.lambda.wf.billed_duration")
+	assert.True(ok)
+}
+
+func TestInvokeZeroArguments(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{})
+	_, err := NewHandlerWrapper(func() error { return nil }, wa).Invoke(newTestContext(), map[string]string{"ignored": "payload"})
+	assert.NoError(err)
+	for _, name := range []string{"aws.lambda.wf.duration", "aws.lambda.wf.mem.total", "aws.lambda.wf.mem.used", "aws.lambda.wf.mem.percentage"} {
+		_, ok := r.GetMetric(name)
+		assert.True(ok, name)
+	}
+	for _, name := range []string{"aws.lambda.wf.invocations", "aws.lambda.wf.coldstarts"} {
+		_, ok := r.GetCounter(name)
+		assert.True(ok, name)
+	}
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	response, err := NewHandlerWrapper(func() (string, error) { return "Hello World", nil }, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal("Hello World", response)
+	_, ok := r.GetMetric("aws.lambda.wf.duration")
+	assert.True(ok)
+	_, ok = r.GetCounter("aws.lambda.wf.invocations")
+	assert.True(ok)
+}
+
+// domainError is a custom error interface, like the ones used for errors with a code.
+type domainError interface {
+	error
+	Code() int
+}
+
+// codeError is a domainError.
+type codeError struct {
+	code int
+}
+
+func (e *codeError) Error() string { return fmt.Sprintf("error with code %d", e.code) }
+func (e *codeError) Code() int     { return e.code }
+
+func TestInvokeCustomErrorTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateReturns(reflect.TypeOf(func() (string, domainError) { return "", nil })))
+	assert.NoError(validateReturns(reflect.TypeOf(func() *codeError { return nil })))
+
+	handlers := []struct {
+		handler interface{}
+		errors  bool
+	}{
+		{func() (string, domainError) { return "ok", nil }, false},
+		{func() (string, domainError) { return "", &codeError{code: 42} }, true},
+		{func() *codeError { return nil }, false},
+		{func() *codeError { return &codeError{code: 42} }, true},
+	}
+
+	for _, h := range handlers {
+		wa, r := newTestAgent(&WavefrontConfig{})
+		_, err := NewHandlerWrapper(h.handler, wa).Invoke(newTestContext(), nil)
+		_, counted := r.GetCounter("aws.lambda.wf.errors")
+		if h.errors {
+			assert.EqualError(err, "error with code 42")
+			assert.IsType(&codeError{}, err)
+			assert.True(counted)
+		} else {
+			assert.NoError(err)
+			assert.False(counted)
+		}
+	}
+}
+
+func TestInvokeOverhead(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := func() { time.Sleep(10 * time.Millisecond) }
+	wa, r := newTestAgent(&WavefrontConfig{Overhead: true})
+	_, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	overhead, ok := r.GetMetric("aws.lambda.wf.overhead")
+	assert.True(ok)
+	assert.True(overhead >= 0)
+	duration, _ := r.GetMetric("aws.lambda.wf.duration")
+	assert.True(overhead < duration)
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	_, err = NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetMetric("aws.lambda.wf.overhead")
+	assert.False(ok)
+}
+
+func TestInvokeStaticPointTags(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{
+		StaticPointTags: map[string]string{"env": "prod", "team": "payments", "Region": "static"},
+		PointTags:       map[string]string{"team": "checkout"},
+	})
+	cs := &commonTagsSender{Recorder: r}
+	wa.sender = cs
+	_, err := NewHandlerWrapper(func() error { return errors.New("failed") }, wa).Invoke(newTestContext(), nil)
+	assert.Error(err)
+	assert.NotEmpty(cs.tags)
+	for _, tags := range cs.tags {
+		assert.Equal("prod", tags["env"])
+		assert.Equal("checkout", tags["team"])
+		assert.Equal("us-west-2", tags["Region"])
+	}
+	_, ok := r.GetCounter("aws.lambda.wf.errors")
+	assert.True(ok)
+	assert.Equal("prod", r.GetTags()["env"])
+}
+
+// slowFlushSender is a Recorder that takes a while to flush.
+type slowFlushSender struct {
+	*Recorder
+}
+
+func (s slowFlushSender) Flush() error {
+	time.Sleep(10 * time.Millisecond)
+	return s.Recorder.Flush()
+}
+
+func TestInvokeFlushDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := func() {}
+	wa, r := newTestAgent(&WavefrontConfig{FlushDuration: true})
+	wa.sender = slowFlushSender{r}
+	hw := NewHandlerWrapper(handler, wa)
+	_, err := hw.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok := r.GetMetric("aws.lambda.wf.flush_duration")
+	assert.False(ok)
+
+	_, err = hw.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	flushDuration, ok := r.GetMetric("aws.lambda.wf.flush_duration")
+	assert.True(ok)
+	assert.True(flushDuration >= 10)
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	hw = NewHandlerWrapper(handler, wa)
+	for i := 0; i < 2; i++ {
+		_, err = hw.Invoke(newTestContext(), nil)
+		assert.NoError(err)
+	}
+	_, ok = r.GetMetric("aws.lambda.wf.flush_duration")
+	assert.False(ok)
+}
+
+func TestInvokeRegionAllowList(t *testing.T) {
+	assert := assert.New(t)
+
+	called := false
+	handler := func() { called = true }
+	wa, r := newTestAgent(&WavefrontConfig{RegionAllowList: []string{"eu-west-1"}})
+	_, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.True(called)
+	assert.Empty(r.metrics)
+	assert.Empty(r.counters)
+
+	wa, r = newTestAgent(&WavefrontConfig{RegionAllowList: []string{"eu-west-1", "us-west-2"}})
+	_, err = NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Contains(r.counters, "aws.lambda.wf.invocations")
+
+	// Without an ARN the region comes from the environment
+	os.Setenv("AWS_REGION", "eu-west-1")
+	defer os.Unsetenv("AWS_REGION")
+	wa, r = newTestAgent(&WavefrontConfig{RegionAllowList: []string{"eu-west-1"}})
+	_, err = NewHandlerWrapper(handler, wa).Invoke(context.Background(), nil)
+	assert.NoError(err)
+	assert.Contains(r.counters, "aws.lambda.wf.invocations")
+
+	os.Setenv("AWS_REGION", "ap-south-1")
+	wa, r = newTestAgent(&WavefrontConfig{RegionAllowList: []string{"eu-west-1"}})
+	_, err = NewHandlerWrapper(handler, wa).Invoke(context.Background(), nil)
+	assert.NoError(err)
+	assert.Empty(r.counters)
+}
+
+// blockingSender is a Recorder that blocks every flush until it receives from release.
+type blockingSender struct {
+	*Recorder
+	release chan struct{}
+}
+
+func (b *blockingSender) Flush() error {
+	<-b.release
+	return b.Recorder.Flush()
+}
+
+func TestInvokeFlushOnErrorOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	setColdStart(t, true)
+	wa, r := newTestAgent(&WavefrontConfig{FlushOnErrorOnly: true, FlushInterval: time.Hour})
+	fail := false
+	hw := NewHandlerWrapper(func() error {
+		if fail {
+			return errors.New("failed")
+		}
+		return nil
+	}, wa)
+	durations := func() int {
+		n := 0
+		for _, name := range r.sent {
+			if name == "aws.lambda.wf.duration" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Cold starts are flushed with their metrics
+	_, err := hw.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal(1, durations())
+	assert.Equal(1, r.flushes)
+
+	// Routine invocations send their counters without metrics or a flush
+	_, err = hw.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal(1, durations())
+	assert.Equal(1, r.flushes)
+	invocations, _ := r.GetCounter("aws.lambda.wf.invocations")
+	assert.Equal(float64(2), invocations)
+
+	// Failed invocations are flushed with their metrics
+	fail = true
+	_, err = hw.Invoke(newTestContext(), nil)
+	assert.Error(err)
+	assert.Equal(2, durations())
+	assert.Equal(2, r.flushes)
+
+	// Routine invocations are flushed once the FlushInterval passed
+	fail = false
+	wa.FlushInterval = time.Nanosecond
+	_, err = hw.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal(2, durations())
+	assert.Equal(3, r.flushes)
+}
+
+func TestInvokeFlushTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{FlushTimeout: 20 * time.Millisecond})
+	bs := &blockingSender{Recorder: r, release: make(chan struct{})}
+	wa.sender = bs
+	start := time.Now()
+	response, err := NewHandlerWrapper(func() (string, error) { return "response", nil }, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal("response", response)
+	assert.True(time.Since(start) < time.Second)
+
+	// The abandoned flush completes in the background
+	close(bs.release)
+	assert.Eventually(func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.flushes == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestInvokeFlushTimeoutNextInvocation(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{FlushTimeout: 20 * time.Millisecond})
+	bs := &blockingSender{Recorder: r, release: make(chan struct{})}
+	wa.sender = bs
+	hw := NewHandlerWrapper(func() {}, wa)
+	_, err := hw.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+
+	// The next invocation drops its data instead of waiting for the abandoned flush
+	r.sent = nil
+	done := make(chan struct{})
+	go func() {
+		hw.Invoke(newTestContext(), nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the invocation waited for the abandoned flush")
+	}
+	assert.Empty(r.sent)
+
+	// Shutdown waits for the abandoned flush
+	close(bs.release)
+	assert.True(wa.Shutdown())
+	assert.Equal(int32(0), atomic.LoadInt32(&wa.abandonedFlushes))
+	assert.Equal(2, r.flushes)
+}
+
+func TestInvokeBackgroundFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{BackgroundFlush: true})
+	bs := &blockingSender{Recorder: r, release: make(chan struct{})}
+	wa.sender = bs
+	hw := NewHandlerWrapper(func() {}, wa)
+
+	_, err := hw.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Contains(r.counters, "aws.lambda.wf.invocations")
+	assert.Equal(0, r.flushes)
+
+	// The next invocation waits for the flush of the previous one
+	done := make(chan struct{})
+	go func() {
+		hw.Invoke(newTestContext(), nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("invocation didn't wait for the background flush")
+	case <-time.After(20 * time.Millisecond):
+	}
+	bs.release <- struct{}{}
+	bs.release <- struct{}{}
+	<-done
+	wa.waitForBackgroundFlush()
+	r.mu.Lock()
+	assert.Equal(2, r.flushes)
+	r.mu.Unlock()
+}
+
+func TestInvokeResponseInterceptor(t *testing.T) {
+	assert := assert.New(t)
+
+	type user struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	}
+	called := false
+	wa, _ := newTestAgent(&WavefrontConfig{
+		ResponseInterceptor: func(response interface{}) interface{} {
+			called = true
+			u := response.(user)
+			u.Email = "redacted"
+			return u
+		},
+	})
+	response, err := NewHandlerWrapper(func() (user, error) {
+		return user{Name: "jane", Email: "jane@example.com"}, nil
+	}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal(user{Name: "jane", Email: "redacted"}, response)
+
+	called = false
+	_, err = NewHandlerWrapper(func() (user, error) {
+		return user{}, errors.New("not found")
+	}, wa).Invoke(newTestContext(), nil)
+	assert.EqualError(err, "not found")
+	assert.False(called)
+}
+
+func TestInvokeConfiguredTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{ConfiguredTimeout: true})
+	ctx, cancel := context.WithTimeout(newTestContext(), 3*time.Second)
+	defer cancel()
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(ctx, nil)
+	assert.NoError(err)
+	timeout, ok := r.GetMetric("aws.lambda.wf.configured_timeout")
+	assert.True(ok)
+	assert.InDelta(3000, timeout, 100)
+
+	wa, r = newTestAgent(&WavefrontConfig{ConfiguredTimeout: true})
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetMetric("aws.lambda.wf.configured_timeout")
+	assert.False(ok)
+
+	// An invocation without a deadline doesn't send the timeout of the previous invocation.
+	wa, r = newTestAgent(&WavefrontConfig{ConfiguredTimeout: true})
+	handler := NewHandlerWrapper(func() {}, wa)
+	_, err = handler.Invoke(ctx, nil)
+	assert.NoError(err)
+	r.sent = nil
+	_, err = handler.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.NotContains(r.sent, "aws.lambda.wf.configured_timeout")
+}
+
+func TestInvokeTimeRemaining(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{TimeRemaining: true})
+	ctx, cancel := context.WithTimeout(newTestContext(), 3*time.Second)
+	defer cancel()
+	_, err := NewHandlerWrapper(func() { time.Sleep(500 * time.Millisecond) }, wa).Invoke(ctx, nil)
+	assert.NoError(err)
+	remaining, ok := r.GetMetric("aws.lambda.wf.time_remaining_ms")
+	assert.True(ok)
+	assert.InDelta(2500, remaining, 100)
+	timeout, ok := r.GetMetric("aws.lambda.wf.timeout_ms")
+	assert.True(ok)
+	assert.InDelta(3000, timeout, 100)
+
+	wa, r = newTestAgent(&WavefrontConfig{TimeRemaining: true})
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetMetric("aws.lambda.wf.time_remaining_ms")
+	assert.False(ok)
+	_, ok = r.GetMetric("aws.lambda.wf.timeout_ms")
+	assert.False(ok)
+
+	// An invocation without a deadline doesn't send the time remaining of the previous invocation.
+	wa, r = newTestAgent(&WavefrontConfig{TimeRemaining: true})
+	handler := NewHandlerWrapper(func() {}, wa)
+	_, err = handler.Invoke(ctx, nil)
+	assert.NoError(err)
+	r.sent = nil
+	_, err = handler.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.NotContains(r.sent, "aws.lambda.wf.time_remaining_ms")
+	assert.NotContains(r.sent, "aws.lambda.wf.timeout_ms")
+
+	// TimeRemaining doesn't send the metric of ConfiguredTimeout
+	assert.NotContains(r.metrics, "aws.lambda.wf.configured_timeout")
+}
+
+// deltaSender is a Recorder that keeps every value sent for each counter, and sums the cold start
+// gauge.
+type deltaSender struct {
+	*Recorder
+	deltas         map[string][]float64
+	coldStartGauge float64
+}
+
+func newDeltaSender(r *Recorder) *deltaSender {
+	return &deltaSender{Recorder: r, deltas: make(map[string][]float64)}
+}
+
+func (d *deltaSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	if name == "aws.lambda.wf.coldstart" {
+		d.coldStartGauge += value
+	}
+	return d.Recorder.SendMetric(name, value, ts, source, tags)
+}
+
+func (d *deltaSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	d.deltas[name] = append(d.deltas[name], value)
+	return d.Recorder.SendDeltaCounter(name, value, source, tags)
+}
+
+func TestInvokeConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	setColdStart(t, true)
+	wa, r := newTestAgent(&WavefrontConfig{ColdStartGauge: true})
+	ds := newDeltaSender(r)
+	wa.sender = ds
+	handler := wrapHandler(func(ctx context.Context) error {
+		wa.RegisterMetric("work", 1)
+		wa.RegisterCounter("items", 1)
+		time.Sleep(time.Millisecond)
+		return nil
+	}, wa)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := handler(newTestContext(), nil)
+			assert.NoError(err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(float64(1), ds.coldStartGauge)
+	assert.Len(ds.deltas["aws.lambda.wf.coldstarts"], 50)
+	assert.Equal(float64(1), sum(ds.deltas["aws.lambda.wf.coldstarts"]))
+	assert.Equal(float64(50), sum(ds.deltas["aws.lambda.wf.invocations"]))
+}
+
+// sum returns the sum of values.
+func sum(values []float64) float64 {
+	total := 0.0
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+func TestInvokeCounterDeltas(t *testing.T) {
+	assert := assert.New(t)
+
+	setColdStart(t, true)
+	wa, r := newTestAgent(&WavefrontConfig{})
+	ds := newDeltaSender(r)
+	wa.sender = ds
+	handler := wrapHandler(func() {}, wa)
+	for i := 0; i < 2; i++ {
+		_, err := handler(newTestContext(), nil)
+		assert.NoError(err)
+	}
+	assert.Equal([]float64{1, 1}, ds.deltas["aws.lambda.wf.invocations"])
+	assert.Equal([]float64{1, 0}, ds.deltas["aws.lambda.wf.coldstarts"])
+
+	// Custom counters are sent once for every time they are registered
+	handler = wrapHandler(func() { wa.RegisterCounter("orders", 3) }, wa)
+	_, err := handler(newTestContext(), nil)
+	assert.NoError(err)
+	_, err = wrapHandler(func() {}, wa)(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal([]float64{3}, ds.deltas["orders"])
+}
+
+func TestInvokeMinDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{MinDuration: time.Hour})
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	duration, _ := r.GetMetric("aws.lambda.wf.duration")
+	assert.Equal(float64(3600000), duration)
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	duration, _ = r.GetMetric("aws.lambda.wf.duration")
+	assert.True(duration < 1000)
+}
+
+func BenchmarkWrapHandlerInvoke(b *testing.B) {
+	wa, _ := newTestAgent(&WavefrontConfig{})
+	handler := wrapHandler(func(ctx context.Context, payload interface{}) (interface{}, error) { return nil, nil }, wa)
+	ctx := newTestContext()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler(ctx, nil)
+	}
+}
+
+// foo is a response of a handler in TestNewHandlerEdgeSignatures.
+type foo struct {
+	Name string `json:"name"`
+}
+
+// contextKey is the type of the context values in TestNewHandlerEdgeSignatures.
+type contextKey string
+
+func TestNewHandlerEdgeSignatures(t *testing.T) {
+	assert := assert.New(t)
+
+	// A payload that can't be marshaled to JSON, so the handlers fail if they try to decode it.
+	payload := make(chan int)
+	ctx := context.WithValue(context.Background(), contextKey("key"), "value")
+
+	called := false
+	response, err := newHandler(func() error {
+		called = true
+		return nil
+	}, false)(ctx, payload)
+	assert.NoError(err)
+	assert.Nil(response)
+	assert.True(called)
+
+	_, err = newHandler(func() error { return errors.New("failed") }, false)(ctx, payload)
+	assert.EqualError(err, "failed")
+
+	response, err = newHandler(func() (foo, error) { return foo{Name: "bar"}, nil }, false)(ctx, payload)
+	assert.NoError(err)
+	assert.Equal(foo{Name: "bar"}, response)
+
+	response, err = newHandler(func() (*foo, error) { return nil, errors.New("not found") }, false)(ctx, payload)
+	assert.EqualError(err, "not found")
+	assert.Nil(response)
+
+	var got interface{}
+	response, err = newHandler(func(ctx context.Context) { got = ctx.Value(contextKey("key")) }, false)(ctx, payload)
+	assert.NoError(err)
+	assert.Nil(response)
+	assert.Equal("value", got)
+
+	// Through the wrapper, the same handlers send their metrics.
+	wa, r := newTestAgent(&WavefrontConfig{})
+	_, err = NewHandlerWrapper(func(ctx context.Context) {}, wa).Invoke(newTestContext(), payload)
+	assert.NoError(err)
+	_, err = NewHandlerWrapper(func() (foo, error) { return foo{}, nil }, wa).Invoke(newTestContext(), payload)
+	assert.NoError(err)
+	invocations, ok := r.GetCounter("aws.lambda.wf.invocations")
+	assert.True(ok)
+	assert.Equal(float64(2), invocations)
+	_, ok = r.GetCounter("aws.lambda.wf.deserialization_errors")
+	assert.False(ok)
+}
+
+func TestNewHandlerRawPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	type order struct {
+		ID    string   `json:"id"`
+		Items []string `json:"items"`
+	}
+	var got []order
+	handler := newHandler(func(o order) error {
+		got = append(got, o)
+		return nil
+	}, false)
+	raw := `{"id":"o-1","items":["book","pen"]}`
+	for _, payload := range []interface{}{
+		map[string]interface{}{"id": "o-1", "items": []interface{}{"book", "pen"}},
+		order{ID: "o-1", Items: []string{"book", "pen"}},
+		[]byte(raw),
+		json.RawMessage(raw),
+	} {
+		_, err := handler(context.Background(), payload)
+		assert.NoError(err)
+	}
+	assert.Len(got, 4)
+	for _, o := range got {
+		assert.Equal(order{ID: "o-1", Items: []string{"book", "pen"}}, o)
+	}
+
+	_, err := handler(context.Background(), []byte(`{"id":`))
+	assert.IsType(&deserializationError{}, err)
+
+	// A []byte event still gets the bytes of a []byte payload.
+	var bytes []byte
+	handler = newHandler(func(b []byte) { bytes = b }, false)
+	_, err = handler(context.Background(), []byte(raw))
+	assert.NoError(err)
+	assert.Equal(raw, string(bytes))
+
+	var rawEvent json.RawMessage
+	handler = newHandler(func(m json.RawMessage) { rawEvent = m }, false)
+	_, err = handler(context.Background(), json.RawMessage(raw))
+	assert.NoError(err)
+	assert.JSONEq(raw, string(rawEvent))
+}
+
+// benchmarkPayload returns a JSON object with n fields.
+func benchmarkPayload(n int) []byte {
+	fields := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		fields[fmt.Sprintf("field%d", i)] = strings.Repeat("x", 64)
+	}
+	payload, _ := json.Marshal(fields)
+	return payload
+}
+
+func BenchmarkNewHandlerMapPayload(b *testing.B) {
+	var payload map[string]interface{}
+	json.Unmarshal(benchmarkPayload(200), &payload)
+	handler := newHandler(func(map[string]string) {}, false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler(context.Background(), payload)
+	}
+}
+
+func BenchmarkNewHandlerRawPayload(b *testing.B) {
+	payload := json.RawMessage(benchmarkPayload(200))
+	handler := newHandler(func(map[string]string) {}, false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler(context.Background(), payload)
+	}
+}
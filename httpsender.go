@@ -0,0 +1,170 @@
+package wflambda
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+// deltaPrefix is the prefix Wavefront uses to recognize delta counters.
+const deltaPrefix = "∆"
+
+// httpSender is a direct ingestion sender that reports to Wavefront through its own http.Client. The
+// direct sender of the Wavefront SDK always uses its internal client, so this sender replaces it when
+// the HTTPClient of the WavefrontConfig is set. It has no background flush and ignores the
+// FlushInterval, so it only flushes when the agent flushes, like at the end of an invocation.
+type httpSender struct {
+	client        *http.Client
+	server        string
+	token         string
+	batchSize     int
+	maxBufferSize int
+	defaultSource string
+
+	mu    sync.Mutex
+	lines []string
+}
+
+// newHTTPSender returns a sender that reports to the Wavefront instance at server with the API token
+// through client, in requests of at most batchSize points. Points beyond maxBufferSize are dropped.
+func newHTTPSender(client *http.Client, server, token string, batchSize, maxBufferSize int) (*httpSender, error) {
+	if server == "" || token == "" {
+		return nil, fmt.Errorf("server and token cannot be empty")
+	}
+	source, err := os.Hostname()
+	if err != nil {
+		source = "wavefront_direct_sender"
+	}
+	return &httpSender{
+		client:        client,
+		server:        strings.TrimSuffix(server, "/"),
+		token:         token,
+		batchSize:     batchSize,
+		maxBufferSize: maxBufferSize,
+		defaultSource: source,
+	}, nil
+}
+
+// SendMetric buffers a single metric until the next flush.
+func (s *httpSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	line, err := wavefront.MetricLine(name, value, ts, source, tags, s.defaultSource)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.lines) >= s.maxBufferSize {
+		return fmt.Errorf("buffer full, dropping line: %s", name)
+	}
+	s.lines = append(s.lines, line)
+	return nil
+}
+
+// SendMetrics buffers all points until the next flush.
+func (s *httpSender) SendMetrics(points []MetricPoint) error {
+	lines := make([]string, 0, len(points))
+	for _, p := range points {
+		line, err := wavefront.MetricLine(p.Name, p.Value, p.Timestamp, p.Source, p.Tags, s.defaultSource)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.lines)+len(lines) > s.maxBufferSize {
+		return fmt.Errorf("buffer full, dropping %d lines", len(lines))
+	}
+	s.lines = append(s.lines, lines...)
+	return nil
+}
+
+// SendDeltaCounter buffers a single delta counter until the next flush.
+func (s *httpSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	if !strings.HasPrefix(name, deltaPrefix) {
+		name = deltaPrefix + name
+	}
+	return s.SendMetric(name, value, 0, source, tags)
+}
+
+// Flush reports all buffered points to Wavefront, in batches of at most batchSize points. A batch that
+// fails doesn't stop the batches after it. Points of batches that fail are dropped, as nothing would
+// report them later, and the errors of all failed batches are returned together.
+func (s *httpSender) Flush() error {
+	s.mu.Lock()
+	lines := s.lines
+	s.lines = nil
+	s.mu.Unlock()
+
+	var errs []error
+	batches := 0
+	for len(lines) > 0 {
+		n := len(lines)
+		if s.batchSize > 0 && n > s.batchSize {
+			n = s.batchSize
+		}
+		batches++
+		if err := s.report(strings.Join(lines[:n], "")); err != nil {
+			errs = append(errs, err)
+		}
+		lines = lines[n:]
+	}
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		return fmt.Errorf("%d of %d batches failed: %s", len(errs), batches, strings.Join(msgs, "; "))
+	}
+}
+
+// report sends the point lines to the report endpoint of Wavefront, compressed with gzip.
+func (s *httpSender) report(lines string) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(lines)); err != nil {
+		zw.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.server+"/report?f=wavefront", &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("error reporting wavefront format data to Wavefront. status=%d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close does nothing, because the agent flushes before it closes the sender.
+func (s *httpSender) Close() error {
+	return nil
+}
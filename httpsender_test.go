@@ -0,0 +1,123 @@
+package wflambda
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingTransport is a RoundTripper that counts the requests it makes.
+type countingTransport struct {
+	mu       sync.Mutex
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.requests++
+	c.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHTTPClient(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	var auth string
+	var lines []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		assert.NoError(err)
+		body, err := ioutil.ReadAll(zr)
+		assert.NoError(err)
+		mu.Lock()
+		defer mu.Unlock()
+		auth = r.Header.Get("Authorization")
+		lines = append(lines, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	lambdacontext.FunctionName = "my-function"
+	lambdacontext.FunctionVersion = "$LATEST"
+	defer func() {
+		lambdacontext.FunctionName = ""
+		lambdacontext.FunctionVersion = ""
+	}()
+	os.Unsetenv("WAVEFRONT_BATCH_SIZE")
+	transport := &countingTransport{}
+	wa, err := NewWavefrontAgentE(
+		WithDirectIngestion(server.URL, "token"),
+		WithHTTPClient(&http.Client{Transport: transport}),
+		WithBatchSize(2),
+		WithEnabled(true),
+	)
+	assert.NoError(err)
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	assert.True(transport.requests > 1)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal("Bearer token", auth)
+	assert.Contains(strings.Join(lines, "\n"), `"aws.lambda.wf.duration"`)
+	assert.Contains(strings.Join(lines, "\n"), `"∆aws.lambda.wf.invocations" 1`)
+}
+
+func TestHTTPSenderErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := newHTTPSender(http.DefaultClient, "", "token", 10, 10)
+	assert.Error(err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	s, err := newHTTPSender(server.Client(), server.URL, "token", 10, 1)
+	assert.NoError(err)
+	assert.NoError(s.SendMetric("orders", 1, 0, "", nil))
+	assert.Error(s.SendMetric("orders", 2, 0, "", nil))
+	assert.Error(s.SendMetrics([]MetricPoint{{Name: "orders", Value: 3}}))
+	assert.EqualError(s.Flush(), "error reporting wavefront format data to Wavefront. status=401")
+	assert.NoError(s.Flush())
+}
+
+func TestHTTPSenderFlushFailedBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	s, err := newHTTPSender(server.Client(), server.URL, "token", 1, 10)
+	assert.NoError(err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(s.SendMetric("orders", float64(i), 0, "", nil))
+	}
+	assert.EqualError(s.Flush(), "2 of 3 batches failed: "+
+		"error reporting wavefront format data to Wavefront. status=503; "+
+		"error reporting wavefront format data to Wavefront. status=503")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(3, requests)
+}
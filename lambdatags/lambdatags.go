@@ -0,0 +1,41 @@
+// Package lambdatags fetches the AWS resource tags of a Lambda function using the AWS SDK, so they
+// can be promoted to point tags by the Wavefront agent. It lives in a separate package to keep the
+// AWS SDK out of functions that don't need it.
+package lambdatags
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+// Fetcher returns a function, to be used as WavefrontConfig.ResourceTags, that lists the tags of a
+// Lambda function using the given client. The function needs the lambda:ListTags permission.
+func Fetcher(client lambdaiface.LambdaAPI) func(arn string) (map[string]string, error) {
+	return func(arn string) (map[string]string, error) {
+		output, err := client.ListTags(&lambda.ListTagsInput{
+			Resource: aws.String(unqualifiedARN(arn)),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		tags := make(map[string]string, len(output.Tags))
+		for k, v := range output.Tags {
+			tags[k] = aws.StringValue(v)
+		}
+		return tags, nil
+	}
+}
+
+// unqualifiedARN strips the version or alias from a function ARN, because tags can only be listed
+// for the function itself.
+func unqualifiedARN(arn string) string {
+	splitArn := strings.Split(arn, ":")
+	if len(splitArn) > 7 {
+		splitArn = splitArn[:7]
+	}
+	return strings.Join(splitArn, ":")
+}
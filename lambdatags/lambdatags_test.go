@@ -0,0 +1,39 @@
+package lambdatags
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeLambda struct {
+	lambdaiface.LambdaAPI
+	resource string
+	err      error
+}
+
+func (f *fakeLambda) ListTags(input *lambda.ListTagsInput) (*lambda.ListTagsOutput, error) {
+	f.resource = aws.StringValue(input.Resource)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &lambda.ListTagsOutput{Tags: map[string]*string{"team": aws.String("payments")}}, nil
+}
+
+func TestFetcher(t *testing.T) {
+	assert := assert.New(t)
+
+	client := &fakeLambda{}
+	tags, err := Fetcher(client)("arn:aws:lambda:us-west-2:123456789012:function:my-function:prod")
+	assert.NoError(err)
+	assert.Equal(map[string]string{"team": "payments"}, tags)
+	assert.Equal("arn:aws:lambda:us-west-2:123456789012:function:my-function", client.resource)
+
+	client = &fakeLambda{err: errors.New("access denied")}
+	_, err = Fetcher(client)("arn:aws:lambda:us-west-2:123456789012:function:my-function")
+	assert.Error(err)
+}
@@ -0,0 +1,41 @@
+package wflambda
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os"
+)
+
+// lineCounter is an io.Writer that counts the lines written through it for an invocation before
+// passing them on to the underlying writer.
+type lineCounter struct {
+	inv *invocation
+	w   io.Writer
+}
+
+// Write counts the number of newlines in p and writes p to the underlying writer.
+func (lc *lineCounter) Write(p []byte) (int, error) {
+	lc.inv.mu.Lock()
+	lc.inv.logLines += bytes.Count(p, []byte{'\n'})
+	lc.inv.mu.Unlock()
+	return lc.w.Write(p)
+}
+
+// Logger returns a logger for the handler to use during the current invocation. Lines written to it
+// go to stderr, just like the standard logger, and are counted for the aws.lambda.wf.log_lines metric.
+// Outside of a wrapped handler a regular, uncounted, logger is returned.
+func Logger(ctx context.Context) *log.Logger {
+	inv := invocationFromContext(ctx)
+	if inv == nil {
+		return log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if inv.logger == nil {
+		inv.logger = log.New(&lineCounter{inv: inv, w: os.Stderr}, "", log.LstdFlags)
+	}
+	return inv.logger
+}
@@ -0,0 +1,40 @@
+package wflambda
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NotNil(Logger(context.Background()))
+
+	ctx, inv := newInvocationContext(context.Background())
+	logger := Logger(ctx)
+	assert.Equal(logger, Logger(ctx))
+
+	var buf bytes.Buffer
+	logger.SetOutput(&lineCounter{inv: inv, w: &buf})
+	logger.Println("hello")
+	logger.Printf("hello %s", "world")
+	assert.Equal(2, inv.lines())
+	assert.Contains(buf.String(), "hello world")
+}
+
+func TestInvokeLogLines(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, fs := newTestAgent(&WavefrontConfig{CountLogLines: true})
+	handler := func(ctx context.Context) error {
+		Logger(ctx).Println("one")
+		Logger(ctx).Println("two")
+		return nil
+	}
+	_, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal(float64(2), fs.metrics["aws.lambda.wf.log_lines"])
+}
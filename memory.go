@@ -1,6 +1,9 @@
 package wflambda
 
-import "github.com/shirou/gopsutil/mem"
+import (
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/shirou/gopsutil/mem"
+)
 
 // memStats contains usage statistics. Total and Used contain numbers of megabytes for human
 // consumption and UsedPercentage contains a percentage value.
@@ -21,3 +24,43 @@ func getMemoryStats() *memStats {
 		UsedPercentage: stats.UsedPercent,
 	}
 }
+
+// memoryStats returns the memory statistics through the readMemStats function of the agent, or
+// getMemoryStats when it has none.
+func (wa *WavefrontAgent) memoryStats() *memStats {
+	if wa.readMemStats != nil {
+		return wa.readMemStats()
+	}
+	return getMemoryStats()
+}
+
+// peakTracker keeps track of the highest used memory (in megabytes) observed in the container.
+type peakTracker struct {
+	peak float64
+}
+
+// Observe records the used memory and returns the highest used memory observed so far.
+func (p *peakTracker) Observe(used float64) float64 {
+	if used > p.peak {
+		p.peak = used
+	}
+	return p.peak
+}
+
+// memoryHeadroom returns the memory limit of the function minus peak, both in megabytes. It returns
+// false as second value when the memory limit isn't known, like when running outside of Lambda.
+func memoryHeadroom(peak float64) (float64, bool) {
+	if lambdacontext.MemoryLimitInMB <= 0 {
+		return 0, false
+	}
+	return float64(lambdacontext.MemoryLimitInMB) - peak, true
+}
+
+// memoryPercentage returns the used memory as a percentage of the total memory visible to the
+// container, or of the memory limit of the function when basis is "limit" and the limit is known.
+func memoryPercentage(stats *memStats, basis string) float64 {
+	if basis == "limit" && lambdacontext.MemoryLimitInMB > 0 {
+		return stats.Used / float64(lambdacontext.MemoryLimitInMB) * 100
+	}
+	return stats.UsedPercentage
+}
@@ -3,6 +3,7 @@ package wflambda
 import (
 	"testing"
 
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -14,3 +15,68 @@ func TestMemory(t *testing.T) {
 	assert.NotZero(stats.Used)
 	assert.NotZero(stats.UsedPercentage)
 }
+
+func TestMemoryHeadroom(t *testing.T) {
+	assert := assert.New(t)
+
+	p := peakTracker{}
+	assert.Equal(float64(40), p.Observe(40))
+	assert.Equal(float64(60), p.Observe(60))
+	assert.Equal(float64(60), p.Observe(50))
+
+	limit := lambdacontext.MemoryLimitInMB
+	defer func() { lambdacontext.MemoryLimitInMB = limit }()
+
+	lambdacontext.MemoryLimitInMB = 0
+	_, ok := memoryHeadroom(60)
+	assert.False(ok)
+
+	lambdacontext.MemoryLimitInMB = 128
+	headroom, ok := memoryHeadroom(60)
+	assert.True(ok)
+	assert.Equal(float64(68), headroom)
+}
+
+func TestMemoryPercentage(t *testing.T) {
+	assert := assert.New(t)
+
+	limit := lambdacontext.MemoryLimitInMB
+	defer func() { lambdacontext.MemoryLimitInMB = limit }()
+
+	stats := &memStats{Total: 3008, Used: 64, UsedPercentage: 2}
+	lambdacontext.MemoryLimitInMB = 128
+	assert.Equal(float64(2), memoryPercentage(stats, ""))
+	assert.Equal(float64(2), memoryPercentage(stats, "total"))
+	assert.Equal(float64(50), memoryPercentage(stats, "limit"))
+
+	lambdacontext.MemoryLimitInMB = 0
+	assert.Equal(float64(2), memoryPercentage(stats, "limit"))
+}
+
+func TestInvokeMemoryGrowth(t *testing.T) {
+	assert := assert.New(t)
+
+	used := []float64{100, 164}
+	readMemStats := func() *memStats {
+		stats := &memStats{Total: 512, Used: used[0]}
+		used = used[1:]
+		return stats
+	}
+	wa, r := newTestAgent(&WavefrontConfig{MemoryGrowth: true})
+	wa.readMemStats = readMemStats
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	growth, ok := r.GetMetric("aws.lambda.wf.mem.growth")
+	assert.True(ok)
+	assert.Equal(float64(64), growth)
+	assert.Empty(used)
+
+	used = []float64{100}
+	wa, r = newTestAgent(&WavefrontConfig{})
+	wa.readMemStats = readMemStats
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetMetric("aws.lambda.wf.mem.growth")
+	assert.False(ok)
+	assert.Empty(used)
+}
@@ -0,0 +1,66 @@
+package wflambda
+
+import (
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+// Metric is a metric with its own emission logic. Metrics registered with the agent are sent at the
+// end of every invocation, with the point tags and source of that invocation.
+type Metric interface {
+	// Send sends the metric to Wavefront through sender.
+	Send(sender wavefront.MetricSender, ts int64, source string, tags map[string]string) error
+}
+
+// Gauge is a Metric that sends a point-in-time value.
+type Gauge struct {
+	Name  string
+	Value float64
+}
+
+// Send sends the value of the gauge as a metric.
+func (g Gauge) Send(sender wavefront.MetricSender, ts int64, source string, tags map[string]string) error {
+	return sender.SendMetric(g.Name, g.Value, ts, source, tags)
+}
+
+// DeltaCounter is a Metric that sends a delta, which is aggregated at the Wavefront server.
+type DeltaCounter struct {
+	Name  string
+	Value float64
+}
+
+// Send sends the value of the counter as a delta counter.
+func (c DeltaCounter) Send(sender wavefront.MetricSender, ts int64, source string, tags map[string]string) error {
+	return sender.SendDeltaCounter(c.Name, c.Value, source, tags)
+}
+
+// agentSender is a wavefront.MetricSender that sends through the agent, so that metrics share the
+// synchronization and flush threshold of the agent.
+type agentSender struct {
+	wa *WavefrontAgent
+}
+
+// SendMetric sends a single metric through the agent.
+func (s agentSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	return s.wa.sendMetric(name, value, ts, source, tags)
+}
+
+// SendDeltaCounter sends a single delta counter through the agent.
+func (s agentSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	return s.wa.sendDeltaCounter(name, value, source, tags)
+}
+
+// lockedSender is a wavefront.MetricSender that sends through the agent while the caller holds the
+// senderMu of the agent, as in sendBatch.
+type lockedSender struct {
+	wa *WavefrontAgent
+}
+
+// SendMetric sends a single metric through the agent.
+func (s lockedSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	return s.wa.sendMetricLocked(name, value, ts, source, tags)
+}
+
+// SendDeltaCounter sends a single delta counter through the agent.
+func (s lockedSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	return s.wa.sendDeltaCounterLocked(name, value, source, tags)
+}
@@ -0,0 +1,56 @@
+package wflambda
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+// setMetric is a custom Metric that sends the number of distinct values it has seen.
+type setMetric struct {
+	name   string
+	values map[string]bool
+}
+
+func (s *setMetric) Send(sender wavefront.MetricSender, ts int64, source string, tags map[string]string) error {
+	return sender.SendMetric(s.name, float64(len(s.values)), ts, source, tags)
+}
+
+func TestMetric(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{})
+	wa.Register(Gauge{Name: "gauge", Value: 42})
+	wa.Register(DeltaCounter{Name: "counter", Value: 2})
+	wa.Register(&setMetric{name: "set", values: map[string]bool{"a": true, "b": true}})
+
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+
+	value, _ := r.GetMetric("gauge")
+	assert.Equal(float64(42), value)
+	value, _ = r.GetCounter("counter")
+	assert.Equal(float64(2), value)
+	value, _ = r.GetMetric("set")
+	assert.Equal(float64(2), value)
+	assert.Equal("my-function", r.GetTags()["Resource"])
+}
+
+func TestRegisterSentOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{})
+	handler := NewHandlerWrapper(func() {}, wa)
+	wa.Register(DeltaCounter{Name: "counter", Value: 2})
+	_, err := handler.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Contains(r.sent, "counter")
+
+	r.sent = nil
+	_, err = handler.Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.NotContains(r.sent, "counter")
+	value, _ := r.GetCounter("counter")
+	assert.Equal(float64(2), value)
+}
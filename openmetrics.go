@@ -0,0 +1,75 @@
+package wflambda
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// writeOpenMetrics writes the metrics and counters, with the given point tags as labels, to w in the
+// OpenMetrics text exposition format. Metrics are written as gauges. Counters are written with the
+// unknown type, because they hold the delta of a single invocation rather than a running total.
+func writeOpenMetrics(w io.Writer, metrics map[string]float64, counters map[string]float64, tags map[string]string) error {
+	labels := openMetricsLabels(tags)
+	bw := bufio.NewWriter(w)
+	writeOpenMetricsFamilies(bw, "gauge", metrics, labels)
+	writeOpenMetricsFamilies(bw, "unknown", counters, labels)
+	bw.WriteString("# EOF\n")
+	return bw.Flush()
+}
+
+// writeOpenMetricsFamilies writes one metric family of the given type per value, sorted by name.
+func writeOpenMetricsFamilies(w *bufio.Writer, metricType string, values map[string]float64, labels string) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		metricName := openMetricsName(name, true)
+		fmt.Fprintf(w, "# TYPE %s %s\n", metricName, metricType)
+		fmt.Fprintf(w, "%s%s %s\n", metricName, labels, strconv.FormatFloat(values[name], 'g', -1, 64))
+	}
+}
+
+// openMetricsLabels returns the label set for the given point tags, sorted by name, or an empty
+// string when there are no tags.
+func openMetricsLabels(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	labels := make([]string, len(keys))
+	for i, k := range keys {
+		labels[i] = openMetricsName(k, false) + `="` + openMetricsEscaper.Replace(tags[k]) + `"`
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// openMetricsEscaper escapes label values.
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// openMetricsName replaces all characters that aren't allowed in a metric name (when metric is true)
+// or label name with an underscore, so aws.lambda.wf.duration becomes aws_lambda_wf_duration.
+func openMetricsName(name string, metric bool) string {
+	var b strings.Builder
+	for i, r := range name {
+		valid := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9') || (metric && r == ':')
+		if valid {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,66 @@
+package wflambda
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteOpenMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	err := writeOpenMetrics(&buf,
+		map[string]float64{"aws.lambda.wf.mem.used": 64, "aws.lambda.wf.duration": 12.5},
+		map[string]float64{"aws.lambda.wf.invocations": 1},
+		map[string]string{"FunctionName": "my-function", "quote": `say "hi"`, "1st": "x"},
+	)
+	assert.NoError(err)
+	labels := `{_st="x",FunctionName="my-function",quote="say \"hi\""}`
+	assert.Equal(`# TYPE aws_lambda_wf_duration gauge
+aws_lambda_wf_duration`+labels+` 12.5
+# TYPE aws_lambda_wf_mem_used gauge
+aws_lambda_wf_mem_used`+labels+` 64
+# TYPE aws_lambda_wf_invocations unknown
+aws_lambda_wf_invocations`+labels+` 1
+# EOF
+`, buf.String())
+
+	buf.Reset()
+	err = writeOpenMetrics(&buf, map[string]float64{"metric": 1}, nil, nil)
+	assert.NoError(err)
+	assert.Equal("# TYPE metric gauge\nmetric 1\n# EOF\n", buf.String())
+}
+
+func TestInvokeOpenMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	reader, writer, err := os.Pipe()
+	assert.NoError(err)
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	output := make(chan []byte)
+	go func() {
+		out, _ := ioutil.ReadAll(reader)
+		output <- out
+	}()
+
+	wa, _ := newTestAgent(&WavefrontConfig{OpenMetrics: true, ConfiguredTimeout: true, Overhead: true})
+	ctx, cancel := context.WithTimeout(newTestContext(), 3*time.Second)
+	defer cancel()
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(ctx, nil)
+	assert.NoError(err)
+	writer.Close()
+	os.Stdout = stdout
+
+	out := string(<-output)
+	assert.Contains(out, "aws_lambda_wf_duration{")
+	assert.Contains(out, "aws_lambda_wf_configured_timeout{")
+	assert.Contains(out, "aws_lambda_wf_overhead{")
+}
@@ -0,0 +1,142 @@
+package wflambda
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Option configures the agent created by NewWavefrontAgent. A *WavefrontConfig is an Option too: it
+// becomes the configuration of the agent, and all other options modify it, regardless of their
+// order.
+type Option interface {
+	apply(w *WavefrontConfig)
+}
+
+// optionFunc is an Option that calls the function with the configuration.
+type optionFunc func(w *WavefrontConfig)
+
+func (f optionFunc) apply(w *WavefrontConfig) {
+	f(w)
+}
+
+// apply does nothing, as NewWavefrontAgent uses the configuration itself as the one the other
+// options are applied to.
+func (w *WavefrontConfig) apply(*WavefrontConfig) {}
+
+// WithEnabled sets whether data is sent to Wavefront. A disabled agent calls the handler without
+// creating a sender or sending any data. The environment variable WAVEFRONT_ENABLED takes precedence.
+func WithEnabled(enabled bool) Option {
+	return optionFunc(func(w *WavefrontConfig) {
+		w.Enabled = &enabled
+	})
+}
+
+// WithProxyAddress sends the data through the Wavefront proxy listening for metrics on the given host
+// and port, instead of using direct ingestion. WithProxyAddress and WithDirectIngestion are mutually
+// exclusive, and the last one wins. The environment variables WAVEFRONT_PROXY_HOST and
+// WAVEFRONT_PROXY_PORT take precedence.
+func WithProxyAddress(host string, port int) Option {
+	return optionFunc(func(w *WavefrontConfig) {
+		w.ProxyHost = &host
+		w.ProxyPort = &port
+		w.Server = nil
+		w.Token = nil
+	})
+}
+
+// WithDirectIngestion sends the data directly to the Wavefront instance at server, a URL of the form
+// https://<INSTANCE>.wavefront.com, with the API token. WithProxyAddress and WithDirectIngestion are
+// mutually exclusive, and the last one wins. The environment variables WAVEFRONT_URL and
+// WAVEFRONT_API_TOKEN take precedence.
+func WithDirectIngestion(server, token string) Option {
+	return optionFunc(func(w *WavefrontConfig) {
+		w.Server = &server
+		w.Token = &token
+		w.ProxyHost = nil
+		w.ProxyPort = nil
+	})
+}
+
+// WithBatchSize sets the max number of points the direct ingestion sender sends to Wavefront in a
+// single request. The environment variable WAVEFRONT_BATCH_SIZE takes precedence.
+func WithBatchSize(n int) Option {
+	return optionFunc(func(w *WavefrontConfig) {
+		w.BatchSize = &n
+	})
+}
+
+// WithHTTPClient sets the HTTP client through which the data is sent with direct ingestion, to set
+// timeouts, a proxy, or TLS roots. The data is then only flushed at the end of every invocation.
+func WithHTTPClient(client *http.Client) Option {
+	return optionFunc(func(w *WavefrontConfig) {
+		w.HTTPClient = client
+	})
+}
+
+// WithFlushInterval sets the interval at which the sender flushes data in the background, in
+// addition to the flush at the end of every invocation.
+func WithFlushInterval(d time.Duration) Option {
+	return optionFunc(func(w *WavefrontConfig) {
+		w.FlushInterval = d
+	})
+}
+
+// WithPointTag adds a point tag that is sent with each data point.
+func WithPointTag(key, value string) Option {
+	return optionFunc(func(w *WavefrontConfig) {
+		if w.PointTags == nil {
+			w.PointTags = make(map[string]string)
+		}
+		w.PointTags[key] = value
+	})
+}
+
+// WithEnvironment sends env, like dev or prod, as the env point tag with each data point.
+func WithEnvironment(env string) Option {
+	return optionFunc(func(w *WavefrontConfig) {
+		w.Environment = env
+	})
+}
+
+// WithSender sends the data through s instead of a sender of the Wavefront SDK.
+func WithSender(s Sender) Option {
+	return optionFunc(func(w *WavefrontConfig) {
+		w.Sender = s
+	})
+}
+
+// validateConfig returns an error when a connection setting of w was set to an invalid value.
+// Settings that weren't set are left to the environment variables and defaults. The errors never
+// contain the token.
+func validateConfig(w *WavefrontConfig) error {
+	if w.Server != nil && *w.Server == "" {
+		return errors.New("wavefront server is empty")
+	}
+	if w.Token != nil && *w.Token == "" {
+		return errors.New("wavefront API token is empty")
+	}
+	if w.BatchSize != nil && *w.BatchSize < 1 {
+		return fmt.Errorf("wavefront batch size %d is less than 1", *w.BatchSize)
+	}
+	if w.ProxyHost != nil && *w.ProxyHost == "" {
+		return errors.New("wavefront proxy host is empty")
+	}
+	if w.ProxyPort != nil && (*w.ProxyPort < 1 || *w.ProxyPort > 65535) {
+		return fmt.Errorf("wavefront proxy port %d is out of range", *w.ProxyPort)
+	}
+	return nil
+}
+
+// validateDirectIngestion returns an error when the resolved server or token for direct ingestion is
+// empty. The error never contains the token.
+func validateDirectIngestion(server, token string) error {
+	if server == "" {
+		return errors.New("wavefront server is empty")
+	}
+	if token == "" {
+		return errors.New("wavefront API token is empty")
+	}
+	return nil
+}
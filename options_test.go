@@ -0,0 +1,161 @@
+package wflambda
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	cs := &countingSender{}
+	wa := NewWavefrontAgent(
+		WithDirectIngestion("https://example.wavefront.com", "token"),
+		WithFlushInterval(5*time.Second),
+		WithPointTag("team", "payments"),
+		WithSender(cs),
+	)
+	assert.Equal("https://example.wavefront.com", *wa.WavefrontConfig.Server)
+	assert.Equal("token", *wa.WavefrontConfig.Token)
+	assert.Equal(5*time.Second, wa.WavefrontConfig.FlushInterval)
+	assert.Equal("payments", wa.WavefrontConfig.PointTags["team"])
+	assert.Equal(cs, wa.sender)
+	assert.NotNil(wa.metrics)
+	assert.NotNil(wa.counters)
+
+	wa = NewWavefrontAgent(WithProxyAddress("localhost", 2878))
+	assert.Equal("localhost", *wa.WavefrontConfig.ProxyHost)
+	assert.Equal(2878, *wa.WavefrontConfig.ProxyPort)
+	assert.NotNil(wa.sender)
+}
+
+func TestOptionsWithConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	enabled := true
+	w := &WavefrontConfig{Enabled: &enabled, PointTags: map[string]string{"env": "prod"}}
+	wa := NewWavefrontAgent(WithPointTag("team", "payments"), w)
+	assert.Same(w, wa.WavefrontConfig)
+	assert.True(*wa.WavefrontConfig.Enabled)
+	assert.Equal("prod", wa.WavefrontConfig.PointTags["env"])
+	assert.Equal("payments", wa.WavefrontConfig.PointTags["team"])
+}
+
+func TestOptionsProxyAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer l.Close()
+	lines := make(chan string, 100)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	wa, err := NewWavefrontAgentE(WithDirectIngestion("https://example.wavefront.com", "token"), WithProxyAddress("127.0.0.1", port), WithEnabled(true))
+	assert.NoError(err)
+	assert.Nil(wa.WavefrontConfig.Server)
+	assert.Nil(wa.WavefrontConfig.Token)
+	assert.Equal("127.0.0.1", *wa.WavefrontConfig.ProxyHost)
+	assert.Equal(port, *wa.WavefrontConfig.ProxyPort)
+	assert.NoError(wa.sendMetric("aws.lambda.wf.duration", 1, 0, "my-function", nil))
+	assert.NoError(wa.flush())
+	select {
+	case line := <-lines:
+		assert.True(strings.HasPrefix(line, `"aws.lambda.wf.duration" 1`), line)
+	case <-time.After(5 * time.Second):
+		assert.Fail("the proxy didn't receive the metric")
+	}
+
+	wa = NewWavefrontAgent(WithProxyAddress("127.0.0.1", port), WithDirectIngestion("https://example.wavefront.com", "token"))
+	assert.Nil(wa.WavefrontConfig.ProxyHost)
+	assert.Nil(wa.WavefrontConfig.ProxyPort)
+	assert.Equal("https://example.wavefront.com", *wa.WavefrontConfig.Server)
+}
+
+func TestNewWavefrontAgentEInvalidProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, err := NewWavefrontAgentE(WithProxyAddress("", 2878))
+	assert.EqualError(err, "wavefront proxy host is empty")
+	assert.Nil(wa)
+
+	wa, err = NewWavefrontAgentE(WithProxyAddress("localhost", 0))
+	assert.EqualError(err, "wavefront proxy port 0 is out of range")
+	assert.Nil(wa)
+
+	_, err = NewWavefrontAgentE(WithProxyAddress("localhost", 65536))
+	assert.EqualError(err, "wavefront proxy port 65536 is out of range")
+}
+
+func TestNewWavefrontAgentEInvalidDirectIngestion(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, err := NewWavefrontAgentE(WithDirectIngestion("https://example.wavefront.com", ""))
+	assert.EqualError(err, "wavefront API token is empty")
+	assert.Nil(wa)
+
+	_, err = NewWavefrontAgentE(WithDirectIngestion("", "secret-token"))
+	assert.EqualError(err, "wavefront server is empty")
+	assert.NotContains(err.Error(), "secret-token")
+
+	_, err = NewWavefrontAgentE(WithDirectIngestion("https://example.wavefront.com", "secret-token"), WithBatchSize(0))
+	assert.EqualError(err, "wavefront batch size 0 is less than 1")
+
+	os.Unsetenv("WAVEFRONT_BATCH_SIZE")
+	wa, err = NewWavefrontAgentE(WithDirectIngestion("https://example.wavefront.com", "secret-token"), WithBatchSize(500), WithFlushInterval(2*time.Second), WithEnabled(true))
+	assert.NoError(err)
+	assert.Equal(500, *wa.WavefrontConfig.BatchSize)
+	assert.Equal(2*time.Second, wa.WavefrontConfig.FlushInterval)
+	assert.NotNil(wa.sender)
+	assert.NotContains(wa.WavefrontConfig.PointTags, "token")
+	for _, v := range wa.WavefrontConfig.PointTags {
+		assert.NotEqual("secret-token", v)
+	}
+}
+
+func TestNewWavefrontAgentEResolvedSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	// Without a server, token, or proxy there is no sender to create.
+	wa, err := NewWavefrontAgentE(WithEnabled(true))
+	assert.EqualError(err, "wavefront server is empty")
+	assert.Nil(wa)
+
+	// The token is required even when it wasn't set at all.
+	server := "https://example.wavefront.com"
+	wa, err = NewWavefrontAgentE(&WavefrontConfig{Server: &server}, WithEnabled(true))
+	assert.EqualError(err, "wavefront API token is empty")
+	assert.Nil(wa)
+	wa, err = NewWavefrontAgentE(&WavefrontConfig{Server: &server}, WithHTTPClient(http.DefaultClient), WithEnabled(true))
+	assert.EqualError(err, "wavefront API token is empty")
+	assert.Nil(wa)
+
+	// The environment variables override the port of the options.
+	os.Setenv("WAVEFRONT_PROXY_PORT", "70000")
+	defer os.Unsetenv("WAVEFRONT_PROXY_PORT")
+	wa, err = NewWavefrontAgentE(WithProxyAddress("localhost", 2878), WithEnabled(true))
+	assert.EqualError(err, "wavefront proxy port 70000 is out of range")
+	assert.Nil(wa)
+
+	// A disabled agent doesn't need a sender.
+	wa, err = NewWavefrontAgentE(WithEnabled(false))
+	assert.NoError(err)
+	assert.NotNil(wa)
+}
@@ -0,0 +1,53 @@
+package wflambda
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxPanicStackLength is the maximum length of the PanicStack point tag. Wavefront limits the key and
+// value of a point tag to 255 characters together.
+const maxPanicStackLength = 200
+
+// panicStack returns the frames of stack, as formatted by debug.Stack, from where the panic was
+// raised, like main.handler(main.go:12);main.process(main.go:30). The arguments, addresses, and
+// directories are left out so the same panic always gets the same value, and the result is cut to
+// max characters.
+func panicStack(stack []byte, max int) string {
+	var frames []string
+	var function string
+	panicked := false
+	for _, line := range strings.Split(string(stack), "\n") {
+		switch {
+		case strings.HasPrefix(line, "\t"):
+			if function == "" {
+				continue
+			}
+			location := strings.TrimSpace(line)
+			if i := strings.LastIndex(location, " +0x"); i >= 0 {
+				location = location[:i]
+			}
+			if panicked {
+				frames = append(frames, function+"("+filepath.Base(location)+")")
+			}
+			if function == "panic" {
+				panicked = true
+			}
+			function = ""
+		case strings.HasPrefix(line, "goroutine "), strings.HasPrefix(line, "created by "), line == "":
+			function = ""
+		default:
+			function = line
+			if i := strings.LastIndex(function, "("); i > 0 {
+				function = function[:i]
+			}
+			function = function[strings.LastIndex(function, "/")+1:]
+		}
+	}
+
+	s := strings.Join(frames, ";")
+	if len(s) > max {
+		s = s[:max]
+	}
+	return s
+}
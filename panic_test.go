@@ -0,0 +1,49 @@
+package wflambda
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPanicStack(t *testing.T) {
+	assert := assert.New(t)
+
+	stack := `goroutine 7 [running]:
+runtime/debug.Stack()
+	/usr/local/go/src/runtime/debug/stack.go:24 +0x5e
+github.com/retgits/wavefront-lambda-go.(*HandlerWrapper).Invoke.func1()
+	/root/module/handler.go:134 +0x8b
+panic({0x6b2d40?, 0x7f4d10?})
+	/usr/local/go/src/runtime/panic.go:770 +0x132
+main.process(0xc000012345)
+	/src/app/main.go:30 +0x25
+main.handler({0x7f5a00, 0xc000010000})
+	/src/app/main.go:12 +0x1a
+created by main.main in goroutine 1
+	/src/app/main.go:40 +0x65
+`
+	assert.Equal("main.process(main.go:30);main.handler(main.go:12)", panicStack([]byte(stack), maxPanicStackLength))
+	assert.Equal("main.process", panicStack([]byte(stack), 12))
+	assert.Empty(panicStack(nil, maxPanicStackLength))
+}
+
+func TestInvokePanicStack(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{})
+	hw := NewHandlerWrapper(func() { panic("boom") }, wa)
+	assert.Panics(func() { hw.Invoke(newTestContext(), nil) })
+	panics, ok := r.GetCounter("aws.lambda.wf.panics")
+	assert.True(ok)
+	assert.Equal(float64(1), panics)
+	stack := r.GetTags()["PanicStack"]
+	assert.Contains(stack, "TestInvokePanicStack")
+	assert.True(len(stack) <= maxPanicStackLength)
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetCounter("aws.lambda.wf.panics")
+	assert.False(ok)
+}
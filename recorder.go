@@ -0,0 +1,122 @@
+package wflambda
+
+import (
+	"sync"
+
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+// Recorder is a sender that records the metrics, counters, and point tags it receives in memory
+// instead of sending them to Wavefront. It is meant to be used in tests, through NewRecordingAgent.
+type Recorder struct {
+	mu       sync.Mutex
+	metrics  map[string]float64
+	counters map[string]float64
+	tags     map[string]string
+	flushes  int
+	// Names of all metrics and counters, in the order they were sent.
+	sent []string
+}
+
+// NewRecordingAgent returns a new agent, configured from w, that records all data in the returned
+// Recorder instead of sending it to Wavefront. The agent is enabled unless w or the environment
+// variable WAVEFRONT_ENABLED disable it. NewRecordingAgent is a test utility.
+func NewRecordingAgent(w *WavefrontConfig) (*WavefrontAgent, *Recorder) {
+	if w.Enabled == nil {
+		enabled := true
+		w.Enabled = &enabled
+	}
+	r := &Recorder{
+		metrics:  make(map[string]float64),
+		counters: make(map[string]float64),
+		tags:     make(map[string]string),
+	}
+	return newWavefrontAgent(w, r), r
+}
+
+// GetMetric returns the last value that was sent for the metric with the given name, and whether
+// the metric was sent at all.
+func (r *Recorder) GetMetric(name string) (float64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	value, ok := r.metrics[name]
+	return value, ok
+}
+
+// GetCounter returns the sum of all deltas that were sent for the counter with the given name, and
+// whether the counter was sent at all.
+func (r *Recorder) GetCounter(name string) (float64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	value, ok := r.counters[name]
+	return value, ok
+}
+
+// GetTags returns a copy of all point tags that were sent with any metric or counter.
+func (r *Recorder) GetTags() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tags := make(map[string]string, len(r.tags))
+	for k, v := range r.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// SendMetric records a single metric.
+func (r *Recorder) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics[name] = value
+	r.record(name, tags)
+	return nil
+}
+
+// SendDeltaCounter records a single delta counter.
+func (r *Recorder) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += value
+	r.record(name, tags)
+	return nil
+}
+
+// record keeps the name and tags of a point that was sent. The caller must hold mu.
+func (r *Recorder) record(name string, tags map[string]string) {
+	r.sent = append(r.sent, name)
+	for k, v := range tags {
+		r.tags[k] = v
+	}
+}
+
+// SendDistribution ignores distributions.
+func (r *Recorder) SendDistribution(name string, centroids []histogram.Centroid, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string) error {
+	return nil
+}
+
+// SendSpan ignores spans.
+func (r *Recorder) SendSpan(name string, startMillis, durationMillis int64, source, traceID, spanID string, parents, followsFrom []string, tags []wavefront.SpanTag, spanLogs []wavefront.SpanLog) error {
+	return nil
+}
+
+// Flush records that the data was flushed.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushes++
+	return nil
+}
+
+// GetFailureCount always returns 0, because recording never fails.
+func (r *Recorder) GetFailureCount() int64 {
+	return 0
+}
+
+// Start does nothing.
+func (r *Recorder) Start() {}
+
+// Close does nothing.
+func (r *Recorder) Close() error {
+	return nil
+}
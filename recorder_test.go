@@ -0,0 +1,33 @@
+package wflambda
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := NewRecordingAgent(&WavefrontConfig{PointTags: map[string]string{"team": "payments"}})
+	assert.True(*wa.Enabled)
+
+	handler := func(ctx context.Context) error { return nil }
+	_, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+
+	_, ok := r.GetMetric("aws.lambda.wf.duration")
+	assert.True(ok)
+	_, ok = r.GetMetric("missing")
+	assert.False(ok)
+	_, ok = r.GetCounter("aws.lambda.wf.invocations")
+	assert.True(ok)
+	assert.Equal("payments", r.GetTags()["team"])
+	assert.Equal(1, r.flushes)
+
+	r.SendDeltaCounter("counter", 1, "source", nil)
+	r.SendDeltaCounter("counter", 2, "source", nil)
+	value, _ := r.GetCounter("counter")
+	assert.Equal(float64(3), value)
+}
@@ -0,0 +1,102 @@
+package wflambda
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// responseTags returns the point tags for the fields of response that are configured in paths, which
+// maps a tag name to a dot separated path into the JSON representation of the response. Fields that
+// are missing or that aren't a string, number, or boolean are skipped, as are values that would make a
+// tag have more than max distinct values. The distinct values per tag are tracked in seen.
+func responseTags(response interface{}, paths map[string]string, max int, seen map[string]map[string]bool) map[string]string {
+	if response == nil || len(paths) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(response)
+	if err != nil {
+		return nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil
+	}
+
+	tags := make(map[string]string)
+	for tag, path := range paths {
+		value, ok := jsonPathValue(doc, path)
+		if !ok {
+			continue
+		}
+		if !seen[tag][value] {
+			if len(seen[tag]) >= max {
+				continue
+			}
+			if seen[tag] == nil {
+				seen[tag] = make(map[string]bool)
+			}
+			seen[tag][value] = true
+		}
+		tags[tag] = value
+	}
+	return tags
+}
+
+// responseError returns the error message at the dot separated path into the JSON representation of
+// response, for handlers that signal application errors in their response instead of returning an
+// error. It returns false when the field is missing, empty, false, or 0, or isn't a string, number, or
+// boolean.
+func responseError(response interface{}, path string) (string, bool) {
+	if response == nil || path == "" {
+		return "", false
+	}
+	b, err := json.Marshal(response)
+	if err != nil {
+		return "", false
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return "", false
+	}
+	value, ok := jsonPathValue(doc, path)
+	if !ok || value == "false" || value == "0" {
+		return "", false
+	}
+	return value, true
+}
+
+// maxResponseTagValues returns the maximum number of distinct values per tag of the ResponseTags and
+// StepFunctionsTags.
+func (wa *WavefrontAgent) maxResponseTagValues() int {
+	if wa.WavefrontConfig.MaxResponseTagValues <= 0 {
+		return defaultMaxResponseTagValues
+	}
+	return wa.WavefrontConfig.MaxResponseTagValues
+}
+
+// jsonPathValue returns the scalar value at the dot separated path in doc, which is the result of
+// unmarshaling JSON into an interface{}, formatted as a string.
+func jsonPathValue(doc interface{}, path string) (string, bool) {
+	value := doc
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = object[key]; !ok {
+			return "", false
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, v != ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,135 @@
+package wflambda
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseTags(t *testing.T) {
+	assert := assert.New(t)
+
+	type routing struct {
+		Region string `json:"region"`
+	}
+	type result struct {
+		Tier     string      `json:"tier"`
+		Priority int         `json:"priority"`
+		Cached   bool        `json:"cached"`
+		Routing  routing     `json:"routing"`
+		Items    []string    `json:"items"`
+		Empty    interface{} `json:"empty"`
+	}
+	paths := map[string]string{
+		"Tier":     "tier",
+		"Priority": "priority",
+		"Cached":   "cached",
+		"Region":   "routing.region",
+		"Items":    "items",
+		"Empty":    "empty",
+		"Missing":  "routing.zone",
+	}
+	seen := make(map[string]map[string]bool)
+
+	tags := responseTags(result{Tier: "gold", Priority: 2, Cached: true, Routing: routing{Region: "eu"}}, paths, 2, seen)
+	assert.Equal(map[string]string{"Tier": "gold", "Priority": "2", "Cached": "true", "Region": "eu"}, tags)
+
+	assert.Empty(responseTags(nil, paths, 2, seen))
+	assert.Empty(responseTags("text", paths, 2, seen))
+
+	// Values beyond the maximum number of distinct values are skipped
+	assert.Equal("silver", responseTags(result{Tier: "silver"}, paths, 2, seen)["Tier"])
+	assert.NotContains(responseTags(result{Tier: "bronze"}, paths, 2, seen), "Tier")
+	assert.Equal("gold", responseTags(result{Tier: "gold"}, paths, 2, seen)["Tier"])
+}
+
+func TestInvokeResponseTags(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{ResponseTags: map[string]string{"Tier": "tier"}})
+	handler := func() (map[string]string, error) {
+		return map[string]string{"tier": "gold"}, nil
+	}
+	_, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal("gold", r.GetTags()["Tier"])
+
+	wa, r = newTestAgent(&WavefrontConfig{ResponseTags: map[string]string{"Tier": "tier"}})
+	_, err = NewHandlerWrapper(func() error { return nil }, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.NotContains(r.GetTags(), "Tier")
+}
+
+func TestResponseError(t *testing.T) {
+	assert := assert.New(t)
+
+	message, ok := responseError(map[string]interface{}{"error": "out of stock"}, "error")
+	assert.True(ok)
+	assert.Equal("out of stock", message)
+	message, ok = responseError(map[string]interface{}{"status": map[string]interface{}{"failed": true}}, "status.failed")
+	assert.True(ok)
+	assert.Equal("true", message)
+
+	for _, response := range []interface{}{
+		nil,
+		"text",
+		map[string]interface{}{},
+		map[string]interface{}{"error": ""},
+		map[string]interface{}{"error": false},
+		map[string]interface{}{"error": 0},
+		map[string]interface{}{"error": nil},
+	} {
+		_, ok = responseError(response, "error")
+		assert.False(ok, "%v", response)
+	}
+}
+
+func TestInvokeResponseError(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{ResponseErrorPath: "error"})
+	handler := func() (map[string]string, error) {
+		return map[string]string{"error": "out of stock"}, nil
+	}
+	_, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	errors, ok := r.GetCounter("aws.lambda.wf.errors")
+	assert.True(ok)
+	assert.Equal(float64(1), errors)
+	assert.Equal("response", r.GetTags()["errorType"])
+
+	wa, r = newTestAgent(&WavefrontConfig{ResponseErrorPath: "error"})
+	_, err = NewHandlerWrapper(func() (map[string]string, error) { return map[string]string{"result": "ok"}, nil }, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetCounter("aws.lambda.wf.errors")
+	assert.False(ok)
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	_, err = NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetCounter("aws.lambda.wf.errors")
+	assert.False(ok)
+}
+
+func TestInvokeStepFunctionsTags(t *testing.T) {
+	assert := assert.New(t)
+
+	paths := map[string]string{"StateMachine": "stateMachine.name", "Task": "state.name"}
+	wa, r := newTestAgent(&WavefrontConfig{StepFunctionsTags: paths})
+	event := map[string]interface{}{
+		"orderId":      "1234",
+		"stateMachine": map[string]interface{}{"name": "checkout"},
+		"state":        map[string]interface{}{"name": "ChargeCard"},
+	}
+	_, err := NewHandlerWrapper(func(map[string]interface{}) error { return nil }, wa).Invoke(newTestContext(), event)
+	assert.NoError(err)
+	assert.Equal("checkout", r.GetTags()["StateMachine"])
+	assert.Equal("ChargeCard", r.GetTags()["Task"])
+
+	// Events of other sources get no tags
+	wa, r = newTestAgent(&WavefrontConfig{StepFunctionsTags: paths})
+	_, err = NewHandlerWrapper(func(map[string]interface{}) error { return nil }, wa).Invoke(newTestContext(), map[string]interface{}{"orderId": "1234"})
+	assert.NoError(err)
+	assert.NotContains(r.GetTags(), "StateMachine")
+	assert.NotContains(r.GetTags(), "Task")
+}
@@ -0,0 +1,60 @@
+package wflambda
+
+import (
+	"log"
+	"time"
+)
+
+// RetryPolicy configures how sends of metrics and counters that fail are retried.
+type RetryPolicy struct {
+	// Maximum number of attempts per point, including the first one. Defaults to 1, which doesn't
+	// retry.
+	MaxAttempts int
+	// Time to wait before the first retry. Every next retry waits twice as long.
+	Backoff time.Duration
+	// Maximum total time an invocation spends waiting for retries. When the next backoff would exceed
+	// it, the point is given up right away, so retries can't run into the timeout of the function.
+	// Defaults to 0, which doesn't limit the time.
+	Budget time.Duration
+}
+
+// startRetryBudget starts the time an invocation may spend on retries of the RetryPolicy.
+func (wa *WavefrontAgent) startRetryBudget() {
+	if !wa.lockSender() {
+		return
+	}
+	defer wa.senderMu.Unlock()
+	wa.retryDeadline = time.Time{}
+	if policy := wa.WavefrontConfig.RetryPolicy; policy != nil && policy.Budget > 0 {
+		wa.retryDeadline = time.Now().Add(policy.Budget)
+	}
+}
+
+// sendWithRetries calls send and, when it fails, calls it again as configured by the RetryPolicy,
+// retrying at least minRetries times, like the CounterSendRetries of counters. Retries beyond the
+// RetryPolicy don't wait. It returns the error of the last attempt. The caller must hold senderMu.
+func (wa *WavefrontAgent) sendWithRetries(name string, minRetries int, send func() error) error {
+	retries := minRetries
+	var backoff time.Duration
+	policy := wa.WavefrontConfig.RetryPolicy
+	if policy != nil {
+		if policy.MaxAttempts-1 > retries {
+			retries = policy.MaxAttempts - 1
+		}
+		backoff = policy.Backoff
+	}
+
+	err := send()
+	for retry := 0; err != nil && retry < retries; retry++ {
+		if policy != nil && retry < policy.MaxAttempts-1 {
+			if !wa.retryDeadline.IsZero() && time.Now().Add(backoff).After(wa.retryDeadline) {
+				log.Printf("ERROR :: retry budget exhausted after %d attempts to send %s", retry+1, name)
+				return err
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		err = send()
+	}
+	return err
+}
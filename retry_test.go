@@ -0,0 +1,62 @@
+package wflambda
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{RetryPolicy: &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}})
+	fs := &flakySender{Recorder: r, failures: 2}
+	wa.sender = fs
+	assert.NoError(wa.sendMetric("metric", 1, 0, "source", nil))
+	_, ok := r.GetMetric("metric")
+	assert.True(ok)
+
+	fs.failures = 2
+	assert.NoError(wa.sendDeltaCounter("counter", 1, "source", nil))
+	_, ok = r.GetCounter("counter")
+	assert.True(ok)
+
+	fs.failures = 3
+	assert.Error(wa.sendMetric("failed", 1, 0, "source", nil))
+	_, ok = r.GetMetric("failed")
+	assert.False(ok)
+
+	// Counters are retried at least CounterSendRetries times
+	wa, r = newTestAgent(&WavefrontConfig{CounterSendRetries: 3, RetryPolicy: &RetryPolicy{MaxAttempts: 2}})
+	fs = &flakySender{Recorder: r, failures: 3}
+	wa.sender = fs
+	assert.NoError(wa.sendDeltaCounter("counter", 1, "source", nil))
+}
+
+func TestRetryPolicyBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{RetryPolicy: &RetryPolicy{MaxAttempts: 10, Backoff: 20 * time.Millisecond, Budget: 30 * time.Millisecond}})
+	fs := &flakySender{Recorder: r, failures: 5}
+	wa.sender = fs
+	wa.startRetryBudget()
+	start := time.Now()
+	assert.Error(wa.sendMetric("metric", 1, 0, "source", nil))
+	assert.True(time.Since(start) < 60*time.Millisecond)
+	// The first retry fits in the budget, the second one doesn't
+	assert.Equal(3, fs.failures)
+}
+
+func TestInvokeRetryPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{RetryPolicy: &RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}})
+	wa.sender = &flakySender{Recorder: r, failures: 1}
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok := r.GetCounter("aws.lambda.wf.invocations")
+	assert.True(ok)
+	_, ok = r.GetMetric("aws.lambda.wf.duration")
+	assert.True(ok)
+}
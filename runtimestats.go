@@ -0,0 +1,20 @@
+package wflambda
+
+import "runtime"
+
+// runtimeMetrics returns the metrics of the Go runtime that are enabled in the configuration: the
+// number of goroutines for Goroutines, and the number of completed GC cycles and their total pause
+// time in milliseconds, both since the container started, for GCStats.
+func (wa *WavefrontAgent) runtimeMetrics() map[string]float64 {
+	metrics := make(map[string]float64)
+	if wa.WavefrontConfig.Goroutines {
+		metrics["aws.lambda.wf.goroutines"] = float64(runtime.NumGoroutine())
+	}
+	if wa.WavefrontConfig.GCStats {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		metrics["aws.lambda.wf.gc.num"] = float64(stats.NumGC)
+		metrics["aws.lambda.wf.gc.pause_ms"] = float64(stats.PauseTotalNs) / 1e6
+	}
+	return metrics
+}
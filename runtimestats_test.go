@@ -0,0 +1,40 @@
+package wflambda
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvokeRuntimeMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{Goroutines: true, GCStats: true})
+	_, err := NewHandlerWrapper(func() { runtime.GC() }, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	goroutines, ok := r.GetMetric("aws.lambda.wf.goroutines")
+	assert.True(ok)
+	assert.True(goroutines >= 1)
+	gcs, ok := r.GetMetric("aws.lambda.wf.gc.num")
+	assert.True(ok)
+	assert.True(gcs >= 1)
+	_, ok = r.GetMetric("aws.lambda.wf.gc.pause_ms")
+	assert.True(ok)
+
+	wa, r = newTestAgent(&WavefrontConfig{Goroutines: true})
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetMetric("aws.lambda.wf.goroutines")
+	assert.True(ok)
+	_, ok = r.GetMetric("aws.lambda.wf.gc.num")
+	assert.False(ok)
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetMetric("aws.lambda.wf.goroutines")
+	assert.False(ok)
+	_, ok = r.GetMetric("aws.lambda.wf.gc.pause_ms")
+	assert.False(ok)
+}
@@ -0,0 +1,55 @@
+package wflambda
+
+import wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+
+// Sender sends the data of the agent. Implementations can be set as the Sender of the WavefrontConfig
+// to route the data elsewhere, like to an aggregator in tests or during local development, and the
+// senders of the Wavefront SDK can be used through SDKSender.
+//
+// All calls are made one at a time. During an invocation the agent sends the metrics and counters,
+// and then calls Flush once, followed by Close once, before the response is returned to Lambda (or,
+// with BackgroundFlush, right after it). The same sender is used again for the next invocation, so
+// Close must leave the sender usable: it marks the end of the data of an invocation, not the end of
+// the sender.
+type Sender interface {
+	// SendMetric sends a single metric with the timestamp ts.
+	SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error
+	// SendDeltaCounter sends a single delta counter.
+	SendDeltaCounter(name string, value float64, source string, tags map[string]string) error
+	// Flush sends all data that is buffered.
+	Flush() error
+	// Close releases the resources that were used for the invocation. An error may mean that data
+	// wasn't delivered.
+	Close() error
+}
+
+// stopper is implemented by senders that have to be stopped for good when the agent shuts down, like
+// the senders of the Wavefront SDK, which can't be used anymore once they are closed.
+type stopper interface {
+	// Stop flushes the sender and releases all its resources.
+	Stop()
+}
+
+// sdkSender adapts a sender of the Wavefront SDK to Sender. The Close of the SDK stops the sender for
+// good, so it is only called by Stop, when the agent shuts down.
+type sdkSender struct {
+	wavefront.Sender
+}
+
+// Close does nothing, because the agent flushes before it closes the sender, and the sender of the
+// Wavefront SDK has to stay usable for the next invocation.
+func (s sdkSender) Close() error {
+	return nil
+}
+
+// Stop closes the sender of the Wavefront SDK.
+func (s sdkSender) Stop() {
+	s.Sender.Close()
+}
+
+// SDKSender returns a Sender that sends through the given sender of the Wavefront SDK, like one
+// created with senders.NewProxySender. Its Close does nothing, and the SDK sender is closed when the
+// agent shuts down.
+func SDKSender(s wavefront.Sender) Sender {
+	return sdkSender{Sender: s}
+}
@@ -0,0 +1,104 @@
+package wflambda
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+	wavefront "github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+func TestInvokeSDKSender(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	invocations := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		if err == nil {
+			body, _ := ioutil.ReadAll(zr)
+			mu.Lock()
+			invocations += strings.Count(string(body), `"∆aws.lambda.wf.invocations" 1`)
+			mu.Unlock()
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	lambdacontext.FunctionName = "my-function"
+	lambdacontext.FunctionVersion = "$LATEST"
+	defer func() {
+		lambdacontext.FunctionName = ""
+		lambdacontext.FunctionVersion = ""
+	}()
+	os.Unsetenv("WAVEFRONT_BATCH_SIZE")
+	wa, err := NewWavefrontAgentE(WithDirectIngestion(server.URL, "token"), WithEnabled(true))
+	assert.NoError(err)
+	handler := NewHandlerWrapper(func() {}, wa)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			_, err := handler.Invoke(newTestContext(), nil)
+			assert.NoError(err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("warm invocations didn't complete")
+	}
+
+	mu.Lock()
+	assert.Equal(3, invocations)
+	mu.Unlock()
+	assert.True(wa.Shutdown())
+}
+
+// flushCountingSender is a sender of the Wavefront SDK that counts its flushes and closes.
+type flushCountingSender struct {
+	wavefront.Sender
+	flushes int
+	closes  int
+}
+
+func (f *flushCountingSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	return nil
+}
+
+func (f *flushCountingSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	return nil
+}
+
+func (f *flushCountingSender) Flush() error {
+	f.flushes++
+	return nil
+}
+
+func (f *flushCountingSender) Close() {
+	f.closes++
+}
+
+func TestInvokeSDKSenderFlushesOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	fs := &flushCountingSender{}
+	wa, _ := newTestAgent(&WavefrontConfig{})
+	wa.sender = SDKSender(fs)
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal(1, fs.flushes)
+	assert.Equal(0, fs.closes)
+
+	wa.Shutdown()
+	assert.Equal(1, fs.closes)
+}
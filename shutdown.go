@@ -0,0 +1,62 @@
+package wflambda
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// startInvocation records that an invocation started.
+func (wa *WavefrontAgent) startInvocation() {
+	atomic.AddInt64(&wa.inFlight, 1)
+}
+
+// endInvocation records that an invocation ended and all its data was handed to the sender.
+func (wa *WavefrontAgent) endInvocation() {
+	atomic.AddInt64(&wa.inFlight, -1)
+}
+
+// Shutdown waits up to ShutdownGracePeriod for in-flight invocations to finish, and for flushes
+// abandoned by FlushTimeout to complete, and then flushes, closes, and stops the sender, after which
+// it can't be used anymore. It returns false when
+// invocations were still in flight after the grace period.
+func (wa *WavefrontAgent) Shutdown() bool {
+	wa.timedFlushes.Wait()
+	drained := wa.drain(time.Now().Add(wa.WavefrontConfig.ShutdownGracePeriod))
+
+	wa.flush()
+	wa.close()
+	wa.stop()
+	return drained
+}
+
+// drain waits until deadline for in-flight invocations to finish. It returns false when invocations
+// were still in flight at the deadline.
+func (wa *WavefrontAgent) drain(deadline time.Time) bool {
+	for atomic.LoadInt64(&wa.inFlight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return atomic.LoadInt64(&wa.inFlight) == 0
+}
+
+// stop stops the sender when it has to be stopped for good, like the senders of the Wavefront SDK.
+func (wa *WavefrontAgent) stop() {
+	wa.senderMu.Lock()
+	defer wa.senderMu.Unlock()
+	if s, ok := wa.sender.(stopper); ok {
+		s.Stop()
+	}
+}
+
+// shutdownOnSIGTERM calls Shutdown when the process receives SIGTERM, which Lambda sends before it
+// shuts down a container that runs extensions.
+func (wa *WavefrontAgent) shutdownOnSIGTERM() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	go func() {
+		<-signals
+		wa.Shutdown()
+	}()
+}
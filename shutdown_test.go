@@ -0,0 +1,28 @@
+package wflambda
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{ShutdownGracePeriod: time.Second})
+	assert.True(wa.Shutdown())
+	assert.Equal(1, r.flushes)
+
+	wa.startInvocation()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		wa.endInvocation()
+	}()
+	assert.True(wa.Shutdown())
+
+	wa, r = newTestAgent(&WavefrontConfig{ShutdownGracePeriod: 20 * time.Millisecond})
+	wa.startInvocation()
+	assert.False(wa.Shutdown())
+	assert.Equal(1, r.flushes)
+}
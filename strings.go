@@ -25,3 +25,13 @@ func stringToInt(s string) (*int, error) {
 	}
 	return &i, nil
 }
+
+// stringToFloat interprets a string s as a 64-bit floating point number and returns a pointer to the
+// corresponding value f. An error is returned when converting the string to a float fails.
+func stringToFloat(s string) (*float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
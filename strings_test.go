@@ -23,4 +23,10 @@ func TestStrings(t *testing.T) {
 	assert.NoError(err)
 	_, err = stringToInt("bla")
 	assert.Error(err)
+
+	f, err := stringToFloat("0.25")
+	assert.Equal(*f, 0.25)
+	assert.NoError(err)
+	_, err = stringToFloat("bla")
+	assert.Error(err)
 }
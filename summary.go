@@ -0,0 +1,23 @@
+package wflambda
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// summary is the single line printed at the end of an invocation when PrintSummary is set. The
+// fields and their order are part of the format and should not change.
+type summary struct {
+	DurationMs     float64           `json:"duration_ms"`
+	ColdStart      bool              `json:"cold_start"`
+	Error          string            `json:"error,omitempty"`
+	MemTotal       float64           `json:"mem_total_mb"`
+	MemUsed        float64           `json:"mem_used_mb"`
+	MemUsedPercent float64           `json:"mem_used_percentage"`
+	Tags           map[string]string `json:"tags"`
+}
+
+// printSummary writes s as a single JSON line to w.
+func printSummary(w io.Writer, s summary) error {
+	return json.NewEncoder(w).Encode(s)
+}
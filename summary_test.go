@@ -0,0 +1,29 @@
+package wflambda
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintSummary(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	err := printSummary(&buf, summary{
+		DurationMs:     12.5,
+		ColdStart:      true,
+		MemTotal:       128,
+		MemUsed:        64,
+		MemUsedPercent: 50,
+		Tags:           map[string]string{"FunctionName": "my-function"},
+	})
+	assert.NoError(err)
+	assert.Equal(`{"duration_ms":12.5,"cold_start":true,"mem_total_mb":128,"mem_used_mb":64,"mem_used_percentage":50,"tags":{"FunctionName":"my-function"}}`+"\n", buf.String())
+
+	buf.Reset()
+	err = printSummary(&buf, summary{Error: "boom"})
+	assert.NoError(err)
+	assert.Contains(buf.String(), `"error":"boom"`)
+}
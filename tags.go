@@ -0,0 +1,201 @@
+package wflambda
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// vpcTags returns the Vpc and Subnet point tags from the environment variables WAVEFRONT_VPC_ID and
+// WAVEFRONT_SUBNET_ID. The Lambda runtime doesn't expose the network configuration of a function, so
+// these variables have to be set by the infrastructure that deploys it. Tags for variables that
+// aren't set are omitted.
+func vpcTags() map[string]string {
+	tags := make(map[string]string)
+	if vpc := os.Getenv("WAVEFRONT_VPC_ID"); vpc != "" {
+		tags["Vpc"] = vpc
+	}
+	if subnet := os.Getenv("WAVEFRONT_SUBNET_ID"); subnet != "" {
+		tags["Subnet"] = subnet
+	}
+	return tags
+}
+
+// defaultEnvTagPrefix is the prefix of the environment variables that are read as point tags when
+// EnvTags is set.
+const defaultEnvTagPrefix = "WF_TAG_"
+
+// envTags returns the point tags from the environment variables whose name starts with prefix, with
+// the prefix stripped from the key, like env=prod for WF_TAG_env=prod. Variables with an empty key or
+// value are skipped, because Wavefront rejects them.
+func envTags(prefix string) map[string]string {
+	tags := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, prefix) {
+			continue
+		}
+		kv = strings.TrimPrefix(kv, prefix)
+		i := strings.Index(kv, "=")
+		if i <= 0 || i == len(kv)-1 {
+			continue
+		}
+		tags[kv[:i]] = kv[i+1:]
+	}
+	return tags
+}
+
+// environment returns the value of the env point tag, which is configured when it isn't empty, or
+// else the value of the environment variable ENVIRONMENT or STAGE.
+func environment(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	if env := os.Getenv("ENVIRONMENT"); env != "" {
+		return env
+	}
+	return os.Getenv("STAGE")
+}
+
+// hasEnvTag reports whether the PointTags or StaticPointTags of w set the env tag, which the
+// environment variables ENVIRONMENT and STAGE then don't replace.
+func hasEnvTag(w *WavefrontConfig) bool {
+	if _, ok := w.PointTags["env"]; ok {
+		return true
+	}
+	_, ok := w.StaticPointTags["env"]
+	return ok
+}
+
+// provisionedTag returns the value of the provisioned point tag, which is true when the container was
+// initialized for provisioned concurrency and false when it was initialized on demand, based on the
+// environment variable AWS_LAMBDA_INITIALIZATION_TYPE. It returns false as second value when the
+// variable isn't set.
+func provisionedTag() (string, bool) {
+	switch os.Getenv("AWS_LAMBDA_INITIALIZATION_TYPE") {
+	case "":
+		return "", false
+	case "provisioned-concurrency":
+		return "true", true
+	default:
+		return "false", true
+	}
+}
+
+// extensionsDir is the directory from which Lambda starts external extensions.
+const extensionsDir = "/opt/extensions"
+
+// extensionsTag returns the value of the Extensions point tag, which is true when dir has external
+// extensions and false when it has none. Lambda doesn't expose the extensions of a function through
+// environment variables, so they are detected from the files in dir. It returns false as second
+// value when the function doesn't run in Lambda, based on the environment variable
+// AWS_LAMBDA_RUNTIME_API, so it can't be detected.
+func extensionsTag(dir string) (string, bool) {
+	if os.Getenv("AWS_LAMBDA_RUNTIME_API") == "" {
+		return "", false
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) == 0 {
+		return "false", true
+	}
+	return "true", true
+}
+
+// TagSource identifies where a point tag comes from.
+type TagSource string
+
+const (
+	// TagSourceConfig are the PointTags and StaticPointTags of the WavefrontConfig, including the
+	// provisioned tag.
+	TagSourceConfig TagSource = "config"
+	// TagSourceFunction are the source, FunctionName, and ExecutedVersion tags of the function, and the
+	// RequestId tag of the invocation.
+	TagSourceFunction TagSource = "function"
+	// TagSourceARN are the tags parsed from the invoked function ARN, or the FallbackTags when there
+	// is no ARN.
+	TagSourceARN TagSource = "arn"
+	// TagSourceResource are the AWS resource tags of the function.
+	TagSourceResource TagSource = "resource"
+	// TagSourceVpc are the Vpc and Subnet tags.
+	TagSourceVpc TagSource = "vpc"
+	// TagSourceStage is the Stage tag taken from the alias of the function.
+	TagSourceStage TagSource = "stage"
+	// TagSourceInvocation are the tags the handler set for the invocation, like with SetOperation.
+	TagSourceInvocation TagSource = "invocation"
+)
+
+// DefaultTagPrecedence is the order in which the point tags of the different sources are merged when
+// the TagPrecedence of the WavefrontConfig is empty. Later sources take precedence over earlier ones
+// when they set the same key.
+var DefaultTagPrecedence = []TagSource{
+	TagSourceConfig,
+	TagSourceFunction,
+	TagSourceARN,
+	TagSourceResource,
+	TagSourceVpc,
+	TagSourceStage,
+	TagSourceInvocation,
+}
+
+// mergeTags returns a new map with the point tags of all sources, merged so that sources later in
+// precedence win over earlier ones. Sources that are missing from precedence are merged first, in the
+// order of DefaultTagPrecedence, so their tags are never dropped. It also returns the rank of the
+// source every tag came from, where tags with a higher rank come from a source with a higher
+// precedence.
+func mergeTags(precedence []TagSource, sources map[TagSource]map[string]string) (map[string]string, map[string]int) {
+	if len(precedence) == 0 {
+		precedence = DefaultTagPrecedence
+	}
+	listed := make(map[TagSource]bool, len(precedence))
+	for _, source := range precedence {
+		listed[source] = true
+	}
+	order := make([]TagSource, 0, len(DefaultTagPrecedence)+len(precedence))
+	for _, source := range DefaultTagPrecedence {
+		if !listed[source] {
+			order = append(order, source)
+		}
+	}
+	order = append(order, precedence...)
+
+	tags := make(map[string]string)
+	ranks := make(map[string]int)
+	for rank, source := range order {
+		for k, v := range sources[source] {
+			tags[k] = v
+			ranks[k] = rank
+		}
+	}
+	return tags, ranks
+}
+
+// capTags returns tags with at most max tags. When tags has more, the tags with the lowest rank are
+// dropped, and for the same rank the tags with the lowest keys. Tags without a rank, like the ones
+// that are specific to a point, are dropped last. tags itself isn't changed.
+func capTags(tags map[string]string, max int, ranks map[string]int) map[string]string {
+	if len(tags) <= max {
+		return tags
+	}
+	rank := func(key string) int {
+		if r, ok := ranks[key]; ok {
+			return r
+		}
+		return math.MaxInt32
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if rank(keys[i]) != rank(keys[j]) {
+			return rank(keys[i]) > rank(keys[j])
+		}
+		return keys[i] > keys[j]
+	})
+	capped := make(map[string]string, max)
+	for _, k := range keys[:max] {
+		capped[k] = tags[k]
+	}
+	return capped
+}
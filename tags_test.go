@@ -0,0 +1,278 @@
+package wflambda
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVpcTags(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Empty(vpcTags())
+
+	os.Setenv("WAVEFRONT_VPC_ID", "vpc-0123")
+	defer os.Unsetenv("WAVEFRONT_VPC_ID")
+	assert.Equal(map[string]string{"Vpc": "vpc-0123"}, vpcTags())
+
+	os.Setenv("WAVEFRONT_SUBNET_ID", "subnet-4567")
+	defer os.Unsetenv("WAVEFRONT_SUBNET_ID")
+	assert.Equal(map[string]string{"Vpc": "vpc-0123", "Subnet": "subnet-4567"}, vpcTags())
+}
+
+func TestProvisionedTag(t *testing.T) {
+	assert := assert.New(t)
+
+	_, ok := provisionedTag()
+	assert.False(ok)
+
+	defer os.Unsetenv("AWS_LAMBDA_INITIALIZATION_TYPE")
+	os.Setenv("AWS_LAMBDA_INITIALIZATION_TYPE", "provisioned-concurrency")
+	value, ok := provisionedTag()
+	assert.True(ok)
+	assert.Equal("true", value)
+
+	os.Setenv("AWS_LAMBDA_INITIALIZATION_TYPE", "on-demand")
+	value, ok = provisionedTag()
+	assert.True(ok)
+	assert.Equal("false", value)
+
+	wa := NewWavefrontAgent(&WavefrontConfig{Enabled: stringToBool("false"), ProvisionedTag: true})
+	assert.Equal("false", wa.PointTags["provisioned"])
+}
+
+func TestMergeTags(t *testing.T) {
+	assert := assert.New(t)
+
+	sources := make(map[TagSource]map[string]string)
+	for _, source := range DefaultTagPrecedence {
+		sources[source] = map[string]string{"key": string(source), string(source): "set"}
+	}
+
+	tags, ranks := mergeTags(nil, sources)
+	assert.Equal("invocation", tags["key"])
+	for i, source := range DefaultTagPrecedence {
+		assert.Equal("set", tags[string(source)])
+		assert.Equal(i, ranks[string(source)])
+	}
+	assert.Equal(len(DefaultTagPrecedence)-1, ranks["key"])
+
+	tags, _ = mergeTags([]TagSource{TagSourceInvocation, TagSourceStage, TagSourceVpc, TagSourceResource, TagSourceARN, TagSourceFunction, TagSourceConfig}, sources)
+	assert.Equal("config", tags["key"])
+
+	// Sources that aren't listed are merged first
+	tags, _ = mergeTags([]TagSource{TagSourceARN}, sources)
+	assert.Equal("arn", tags["key"])
+	assert.Equal("set", tags["invocation"])
+
+	delete(sources, TagSourceARN)
+	tags, _ = mergeTags([]TagSource{TagSourceARN}, sources)
+	assert.Equal("invocation", tags["key"])
+}
+
+func TestInvokeTagPrecedence(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("WAVEFRONT_VPC_ID", "vpc-0123")
+	defer os.Unsetenv("WAVEFRONT_VPC_ID")
+	handler := func(ctx context.Context) {
+		SetOperation(ctx, "checkout")
+	}
+	config := func() *WavefrontConfig {
+		return &WavefrontConfig{
+			PointTags: map[string]string{"Region": "config", "Vpc": "config", "Operation": "config"},
+			VpcTags:   true,
+		}
+	}
+
+	wa, r := newTestAgent(config())
+	_, err := NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	tags := r.GetTags()
+	assert.Equal("us-west-2", tags["Region"])
+	assert.Equal("vpc-0123", tags["Vpc"])
+	assert.Equal("checkout", tags["Operation"])
+	assert.Equal(map[string]string{"Region": "config", "Vpc": "config", "Operation": "config"}, wa.PointTags)
+
+	w := config()
+	w.TagPrecedence = []TagSource{TagSourceInvocation, TagSourceConfig}
+	wa, r = newTestAgent(w)
+	_, err = NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	tags = r.GetTags()
+	assert.Equal("config", tags["Region"])
+	assert.Equal("config", tags["Vpc"])
+	assert.Equal("config", tags["Operation"])
+	assert.Equal("my-function", tags["Resource"])
+}
+
+func TestGoMaxProcsTag(t *testing.T) {
+	assert := assert.New(t)
+
+	wa := NewWavefrontAgent(&WavefrontConfig{Enabled: stringToBool("false"), GoMaxProcsTag: true})
+	assert.Equal(strconv.Itoa(runtime.GOMAXPROCS(0)), wa.PointTags["GoMaxProcs"])
+
+	wa = NewWavefrontAgent(&WavefrontConfig{Enabled: stringToBool("false")})
+	assert.NotContains(wa.PointTags, "GoMaxProcs")
+}
+
+func TestEnvTags(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("WF_TAG_env", "prod")
+	defer os.Unsetenv("WF_TAG_env")
+	os.Setenv("WF_TAG_team", "payments")
+	defer os.Unsetenv("WF_TAG_team")
+	os.Setenv("WF_TAG_empty", "")
+	defer os.Unsetenv("WF_TAG_empty")
+	os.Setenv("WF_TAG_", "nokey")
+	defer os.Unsetenv("WF_TAG_")
+	os.Setenv("MY_TAG_Region", "static")
+	defer os.Unsetenv("MY_TAG_Region")
+
+	assert.Equal(map[string]string{"env": "prod", "team": "payments"}, envTags(defaultEnvTagPrefix))
+	assert.Equal(map[string]string{"Region": "static"}, envTags("MY_TAG_"))
+
+	wa := NewWavefrontAgent(&WavefrontConfig{Enabled: stringToBool("false"), EnvTags: true, PointTags: map[string]string{"team": "checkout", "owner": "me"}})
+	assert.Equal(map[string]string{"env": "prod", "team": "payments", "owner": "me"}, wa.PointTags)
+
+	wa = NewWavefrontAgent(&WavefrontConfig{Enabled: stringToBool("false")})
+	assert.NotContains(wa.PointTags, "env")
+
+	// Tags derived from AWS win over the tags from the environment
+	wa, r := newTestAgent(&WavefrontConfig{EnvTags: true, EnvTagPrefix: "MY_TAG_"})
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal("us-west-2", r.GetTags()["Region"])
+}
+
+func TestEnvironment(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Empty(environment(""))
+	assert.Equal("prod", environment("prod"))
+
+	os.Setenv("STAGE", "staging")
+	defer os.Unsetenv("STAGE")
+	assert.Equal("staging", environment(""))
+	os.Setenv("ENVIRONMENT", "dev")
+	defer os.Unsetenv("ENVIRONMENT")
+	assert.Equal("dev", environment(""))
+	assert.Equal("prod", environment("prod"))
+
+	wa := NewWavefrontAgent(WithEnabled(false), WithEnvironment("prod"))
+	assert.Equal("prod", wa.PointTags["env"])
+	wa = NewWavefrontAgent(WithEnabled(false))
+	assert.Equal("dev", wa.PointTags["env"])
+
+	// The environment variables don't replace an env tag that is configured explicitly
+	wa = NewWavefrontAgent(WithEnabled(false), WithPointTag("env", "prod"))
+	assert.Equal("prod", wa.PointTags["env"])
+	wa = NewWavefrontAgent(WithEnabled(false), WithEnvironment("staging"), WithPointTag("env", "prod"))
+	assert.Equal("staging", wa.PointTags["env"])
+	wa, r := newTestAgent(&WavefrontConfig{StaticPointTags: map[string]string{"env": "prod"}})
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Equal("prod", r.GetTags()["env"])
+
+	wa, r = newTestAgent(&WavefrontConfig{Environment: "prod"})
+	cs := &commonTagsSender{Recorder: r}
+	wa.sender = cs
+	_, err = NewHandlerWrapper(func() error { return errors.New("failed") }, wa).Invoke(newTestContext(), nil)
+	assert.Error(err)
+	for _, tags := range cs.tags {
+		assert.Equal("prod", tags["env"])
+	}
+	_, ok := r.GetCounter("aws.lambda.wf.errors")
+	assert.True(ok)
+}
+
+func TestExtensionsTag(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "extensions")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	_, ok := extensionsTag(dir)
+	assert.False(ok)
+
+	os.Setenv("AWS_LAMBDA_RUNTIME_API", "127.0.0.1:9001")
+	defer os.Unsetenv("AWS_LAMBDA_RUNTIME_API")
+	value, ok := extensionsTag(dir)
+	assert.True(ok)
+	assert.Equal("false", value)
+
+	value, _ = extensionsTag(filepath.Join(dir, "missing"))
+	assert.Equal("false", value)
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "telemetry-extension"), nil, 0755))
+	value, _ = extensionsTag(dir)
+	assert.Equal("true", value)
+}
+
+func TestCapTags(t *testing.T) {
+	assert := assert.New(t)
+
+	tags := map[string]string{"a": "1", "b": "2", "c": "3", "phase": "init"}
+	ranks := map[string]int{"a": 0, "b": 0, "c": 1}
+	assert.Equal(tags, capTags(tags, 4, ranks))
+	assert.Equal(map[string]string{"b": "2", "c": "3", "phase": "init"}, capTags(tags, 3, ranks))
+	assert.Equal(map[string]string{"c": "3", "phase": "init"}, capTags(tags, 2, ranks))
+	assert.Equal(map[string]string{"phase": "init"}, capTags(tags, 1, ranks))
+	assert.Len(tags, 4)
+}
+
+func TestInvokeMaxPointTags(t *testing.T) {
+	assert := assert.New(t)
+
+	pointTags := make(map[string]string)
+	for i := 0; i < 25; i++ {
+		pointTags[fmt.Sprintf("tag%02d", i)] = "value"
+	}
+	setColdStart(t, false)
+	wa, r := newTestAgent(&WavefrontConfig{PointTags: pointTags})
+	cs := &commonTagsSender{Recorder: r}
+	wa.sender = cs
+	_, err := NewHandlerWrapper(func() error { return errors.New("failed") }, wa).Invoke(newTestContext(), nil)
+	assert.Error(err)
+	for _, tags := range cs.tags {
+		assert.Len(tags, 20)
+		assert.Equal("us-west-2", tags["Region"])
+		assert.NotContains(tags, "tag00")
+		assert.Contains(tags, "tag24")
+	}
+	assert.Equal("invoke", r.GetTags()["phase"])
+
+	wa, r = newTestAgent(&WavefrontConfig{PointTags: pointTags, MaxPointTags: 40})
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	assert.Contains(r.GetTags(), "tag00")
+}
+
+func TestInvokeRequestIDTag(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{
+		AwsRequestID:       "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0",
+		InvokedFunctionArn: "arn:aws:lambda:us-west-2:123456789012:function:my-function",
+	})
+	wa, r := newTestAgent(&WavefrontConfig{RequestIDTag: true})
+	_, err := NewHandlerWrapper(func() {}, wa).Invoke(ctx, nil)
+	assert.NoError(err)
+	assert.Equal("0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0", r.GetTags()["RequestId"])
+
+	wa, r = newTestAgent(&WavefrontConfig{})
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(ctx, nil)
+	assert.NoError(err)
+	assert.NotContains(r.GetTags(), "RequestId")
+}
@@ -0,0 +1,39 @@
+package wflambda
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// startDeadlineWatchdog starts a goroutine that sends the deadline exceeded while running counter,
+// with the point tags that tags returns, and flushes it, when the handler still runs margin before
+// deadline. It returns a function that stops the watchdog and waits for it, which can be called more
+// than once.
+func (wa *WavefrontAgent) startDeadlineWatchdog(deadline time.Time, margin time.Duration, tags func() map[string]string) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		timer := time.NewTimer(time.Until(deadline.Add(-margin)))
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+			log.Printf("WARNING :: handler is still running %s before the deadline", margin)
+			logError(wa.sendDeltaCounter("aws.lambda.wf.deadline_exceeded_while_running", 1, lambdacontext.FunctionName, tags()))
+			logError(wa.flush())
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package wflambda
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvokeDeadlineWatchdog(t *testing.T) {
+	assert := assert.New(t)
+
+	wa, r := newTestAgent(&WavefrontConfig{DeadlineWatchdog: 20 * time.Millisecond})
+	handler := func() { time.Sleep(50 * time.Millisecond) }
+	ctx, cancel := context.WithTimeout(newTestContext(), 40*time.Millisecond)
+	defer cancel()
+	_, err := NewHandlerWrapper(handler, wa).Invoke(ctx, nil)
+	assert.NoError(err)
+	exceeded, ok := r.GetCounter("aws.lambda.wf.deadline_exceeded_while_running")
+	assert.True(ok)
+	assert.Equal(float64(1), exceeded)
+
+	// Handlers that return in time, and invocations without a deadline, aren't counted
+	wa, r = newTestAgent(&WavefrontConfig{DeadlineWatchdog: 20 * time.Millisecond})
+	ctx, cancel = context.WithTimeout(newTestContext(), time.Second)
+	defer cancel()
+	_, err = NewHandlerWrapper(func() {}, wa).Invoke(ctx, nil)
+	assert.NoError(err)
+	_, err = NewHandlerWrapper(handler, wa).Invoke(newTestContext(), nil)
+	assert.NoError(err)
+	_, ok = r.GetCounter("aws.lambda.wf.deadline_exceeded_while_running")
+	assert.False(ok)
+}